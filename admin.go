@@ -0,0 +1,217 @@
+package caddy_ondemand_upstreams
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Interface guards.
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(AdminAPI))
+}
+
+// AdminAPI is a module that serves endpoints for inspecting and controlling
+// ondemand upstreams through Caddy's admin API:
+//
+//	GET /ondemand/
+//
+// lists every running upstream process.
+//
+//	GET /ondemand/<name>/logs?lines=N
+//
+// returns the last N lines of the named upstream's output (see log_buffer), as
+// JSON, or as plain text if format=text is given.
+//
+//	POST /ondemand/<name>/start
+//	POST /ondemand/<name>/stop?pid=N
+//
+// start the named upstream's process ahead of any requests, or stop its
+// processes (or only the one with the given PID).
+type AdminAPI struct{}
+
+// CaddyModule returns the Caddy module information.
+func (*AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.ondemand",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Routes implements caddy.AdminRouter.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/ondemand/",
+			Handler: caddy.AdminHandlerFunc(a.handle),
+		},
+	}
+}
+
+// handle routes a request for /ondemand/<name>/<action> to the named upstream.
+func (a *AdminAPI) handle(w http.ResponseWriter, r *http.Request) error {
+	path := strings.TrimPrefix(r.URL.Path, "/ondemand/")
+	if path == "" {
+		return a.handleList(w, r)
+	}
+
+	parts := strings.Split(path, "/")
+	if len(parts) != 2 || parts[0] == "" {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("expected /ondemand/<name>/<action>"),
+		}
+	}
+
+	o, ok := lookupUpstream(parts[0])
+	if !ok {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("upstream not found: %s", parts[0]),
+		}
+	}
+
+	switch parts[1] {
+	case "logs":
+		return a.handleLogs(w, r, o)
+	case "start":
+		return a.handleStart(w, r, o)
+	case "stop":
+		return a.handleStop(w, r, o)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("unknown action: %s", parts[1]),
+		}
+	}
+}
+
+// handleList writes a description of every running process.
+func (a *AdminAPI) handleList(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	processes := listProcesses()
+	infos := make([]processInfo, 0, len(processes))
+	for _, process := range processes {
+		infos = append(infos, process.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Upstream != infos[j].Upstream {
+			return infos[i].Upstream < infos[j].Upstream
+		}
+		return infos[i].PID < infos[j].PID
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(infos)
+}
+
+// handleStart starts the upstream's process ahead of any requests.
+func (a *AdminAPI) handleStart(w http.ResponseWriter, r *http.Request, o *OndemandUpstreams) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	if err := o.Prewarm(); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("starting upstream %s: %v", o.Name, err),
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleStop stops the upstream's processes.
+func (a *AdminAPI) handleStop(w http.ResponseWriter, r *http.Request, o *OndemandUpstreams) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	pid := 0
+	if v := r.URL.Query().Get("pid"); v != "" {
+		var err error
+		pid, err = strconv.Atoi(v)
+		if err != nil || pid <= 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid pid: %s", v),
+			}
+		}
+	}
+
+	if o.StopProcesses(pid) == 0 && pid != 0 {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("no running process with pid %d in upstream %s", pid, o.Name),
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleLogs writes the upstream's most recent output lines.
+func (a *AdminAPI) handleLogs(w http.ResponseWriter, r *http.Request, o *OndemandUpstreams) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed"),
+		}
+	}
+
+	if o.outputBuffer == nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusNotFound,
+			Err:        fmt.Errorf("log_buffer is not enabled for upstream: %s", o.Name),
+		}
+	}
+
+	// Return as many lines as were asked for, up to the size of the buffer.
+	n := o.LogBuffer
+	if v := r.URL.Query().Get("lines"); v != "" {
+		lines, err := strconv.Atoi(v)
+		if err != nil || lines < 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("invalid lines: %s", v),
+			}
+		}
+		if lines < n {
+			n = lines
+		}
+	}
+	lines := o.outputBuffer.Last(n)
+
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, line := range lines {
+			fmt.Fprintln(w, line.Line)
+		}
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(lines)
+}
@@ -0,0 +1,117 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// adminRequest makes a request to the admin API and returns the response.
+func adminRequest(t *testing.T, method, target string) (*httptest.ResponseRecorder, error) {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	err := new(AdminAPI).handle(w, httptest.NewRequest(method, target, nil))
+	return w, err
+}
+
+func TestListDoesNotWaitForStop(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:                   "slow-stop",
+		Command:                "trap '' INT; sleep 30",
+		Port:                   1,
+		TerminationGracePeriod: caddy.Duration(2 * time.Second),
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	pid := process.Info().PID
+
+	stopped := make(chan struct{})
+	go func() {
+		process.Stop()
+		close(stopped)
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	listed := make(chan []processInfo)
+	go func() {
+		w, err := adminRequest(t, http.MethodGet, "/ondemand/")
+		if err != nil {
+			t.Error(err)
+		}
+		var infos []processInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+			t.Error(err)
+		}
+		listed <- infos
+	}()
+
+	select {
+	case infos := <-listed:
+		if len(infos) != 1 || infos[0].PID != pid {
+			t.Fatalf("expected the stopping process to be listed, got %+v", infos)
+		}
+	case <-stopped:
+		t.Fatal("listing processes waited for the process to stop")
+	}
+	<-stopped
+}
+
+func TestStartRejectsRequestPlaceholders(t *testing.T) {
+	newTestUpstream(t, &OndemandUpstreams{
+		Name:    "per-host",
+		Command: helperCommand("serve", "%d", "{http.request.host}"),
+	})
+
+	_, err := adminRequest(t, http.MethodPost, "/ondemand/per-host/start")
+	if err == nil || !strings.Contains(err.Error(), "request placeholders") {
+		t.Fatalf("expected starting to fail because of the request placeholder, got %v", err)
+	}
+}
+
+func TestLogsReturnsRecentOutput(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:       "with-logs",
+		Command:    "for i in 1 2 3 4; do echo line$i; done; exec sleep 30",
+		Port:       1,
+		StdoutFile: filepath.Join(t.TempDir(), "stdout.log"),
+		LogBuffer:  3,
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the output to be captured", func() bool {
+		lines := o.outputBuffer.Last(1)
+		return len(lines) == 1 && lines[0].Line == "line4"
+	})
+
+	w, err := adminRequest(t, http.MethodGet, "/ondemand/with-logs/logs?lines=2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []outputLine
+	if err := json.Unmarshal(w.Body.Bytes(), &lines); err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0].Line != "line3" || lines[1].Line != "line4" || lines[0].Stream != "stdout" {
+		t.Fatalf("expected the last 2 lines, got %+v", lines)
+	}
+
+	w, err = adminRequest(t, http.MethodGet, "/ondemand/with-logs/logs?format=text")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := w.Body.String(); got != "line2\nline3\nline4\n" {
+		t.Fatalf("expected the buffered lines as text, got %q", got)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// checkUser returns an error because running processes as another user isn't
+// supported on this platform.
+func checkUser(name string) error {
+	return fmt.Errorf("user is not supported on %s", runtime.GOOS)
+}
+
+// setUser returns an error because running processes as another user isn't
+// supported on this platform.
+func setUser(cmd *exec.Cmd, name string) error {
+	return fmt.Errorf("user is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,104 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// checkUser returns an error if processes can't be run as the given user,
+// either because the user doesn't exist or because Caddy doesn't have the
+// privileges needed to switch to it.
+func checkUser(name string) error {
+	cred, err := lookupCredential(name)
+	if err != nil {
+		return err
+	}
+
+	if os.Geteuid() != 0 && (cred.Uid != uint32(os.Geteuid()) || cred.Gid != uint32(os.Getegid())) {
+		return fmt.Errorf("caddy must run as root to run upstream processes as user %s", name)
+	}
+
+	return nil
+}
+
+// setUser configures cmd to run as the given user, including the user's
+// supplementary groups.
+func setUser(cmd *exec.Cmd, name string) error {
+	cred, err := lookupCredential(name)
+	if err != nil {
+		return err
+	}
+
+	// If Caddy is already running as this user, there's nothing to switch and
+	// a non-root process wouldn't be allowed to set its groups anyway.
+	if os.Geteuid() != 0 && cred.Uid == uint32(os.Geteuid()) && cred.Gid == uint32(os.Getegid()) {
+		return nil
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = cred
+
+	return nil
+}
+
+// lookupCredential resolves a username, a numeric uid, or a numeric uid:gid
+// pair into a credential.
+func lookupCredential(name string) (*syscall.Credential, error) {
+	var uid, gid uint64
+	var u *user.User
+	var err error
+
+	if uidStr, gidStr, ok := strings.Cut(name, ":"); ok {
+		if uid, err = strconv.ParseUint(uidStr, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid uid %q: %v", uidStr, err)
+		}
+		if gid, err = strconv.ParseUint(gidStr, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid gid %q: %v", gidStr, err)
+		}
+		// The uid doesn't have to belong to a known user, but if it does, use
+		// its supplementary groups.
+		u, _ = user.LookupId(uidStr)
+	} else {
+		u, err = user.Lookup(name)
+		if err != nil {
+			if _, convErr := strconv.ParseUint(name, 10, 32); convErr != nil {
+				return nil, fmt.Errorf("looking up user %s: %v", name, err)
+			}
+			if u, err = user.LookupId(name); err != nil {
+				return nil, fmt.Errorf("looking up user %s: %v", name, err)
+			}
+		}
+		if uid, err = strconv.ParseUint(u.Uid, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid uid for user %s: %v", name, err)
+		}
+		if gid, err = strconv.ParseUint(u.Gid, 10, 32); err != nil {
+			return nil, fmt.Errorf("invalid gid for user %s: %v", name, err)
+		}
+	}
+
+	cred := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if u != nil {
+		groupIds, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("looking up groups for user %s: %v", name, err)
+		}
+		for _, g := range groupIds {
+			id, err := strconv.ParseUint(g, 10, 32)
+			if err != nil {
+				continue
+			}
+			cred.Groups = append(cred.Groups, uint32(id))
+		}
+	}
+
+	return cred, nil
+}
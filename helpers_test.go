@@ -0,0 +1,147 @@
+package caddy_ondemand_upstreams
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/signal"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
+)
+
+// TestHelperProcess isn't a real test. It's run as the upstream process by
+// the other tests; see helperCommand.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("ONDEMAND_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "no helper command")
+		os.Exit(2)
+	}
+
+	switch args[1] {
+	case "serve", "serve-ignoring-interrupt":
+		// serve <port> [body]: serve body (default "ok") on every path.
+		// serve-ignoring-interrupt does the same, but can only be killed.
+		if args[1] == "serve-ignoring-interrupt" {
+			signal.Ignore(os.Interrupt)
+		}
+		body := "ok"
+		if len(args) > 3 {
+			body = args[3]
+		}
+		err := http.ListenAndServe(net.JoinHostPort("localhost", args[2]), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	default:
+		fmt.Fprintln(os.Stderr, "unknown helper command: "+args[1])
+		os.Exit(2)
+	}
+}
+
+// helperCommand returns a command that runs TestHelperProcess with the given
+// arguments. The process must be run with helperEnv.
+func helperCommand(args ...string) string {
+	return os.Args[0] + " -test.run=^TestHelperProcess$ -- " + strings.Join(args, " ")
+}
+
+var helperEnv = map[string]string{"ONDEMAND_HELPER_PROCESS": "1"}
+
+// newTestUpstream provisions and validates o, and cleans it up once the test
+// is done.
+func newTestUpstream(t *testing.T, o *OndemandUpstreams) *OndemandUpstreams {
+	t.Helper()
+
+	if o.Env == nil {
+		o.Env = helperEnv
+	}
+	if err := o.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		o.Cleanup()
+	})
+
+	return o
+}
+
+// newTestRequest returns a request for host, with a replacer in its context
+// the way Caddy sets one up. The request's context is done once cancel is
+// called, like a proxied request's is once it has been handled.
+func newTestRequest(host string) (*http.Request, context.CancelFunc) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Host = host
+
+	// Like Caddy's, the placeholder is the host without the port.
+	hostname, _, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname = host
+	}
+	repl := caddy.NewReplacer()
+	repl.Set("http.request.host", hostname)
+	ctx, cancel := context.WithCancel(context.WithValue(r.Context(), caddy.ReplacerCtxKey, repl))
+
+	return r.WithContext(ctx), cancel
+}
+
+// testProcesses returns every process that o has created.
+func testProcesses(o *OndemandUpstreams) []*UpstreamProcess {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var processes []*UpstreamProcess
+	for _, t := range o.tenants {
+		processes = append(processes, t.processes...)
+	}
+	return processes
+}
+
+// waitFor fails the test if cond doesn't become true within timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// get makes a request to o and returns the error, if any.
+func get(o *OndemandUpstreams) error {
+	r, cancel := newTestRequest("example.com")
+	defer cancel()
+	upstreams, err := o.GetUpstreams(r)
+	if err != nil {
+		return err
+	}
+	selectUpstream(r, upstreams[0])
+	return nil
+}
+
+// selectUpstream returns the address of the given upstream, resolved the way
+// the reverse proxy does for the upstream its load balancing policy selects.
+func selectUpstream(r *http.Request, upstream *reverseproxy.Upstream) string {
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	return repl.ReplaceAll(upstream.Dial, "")
+}
@@ -0,0 +1,54 @@
+package caddy_ondemand_upstreams
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics are registered with the default Prometheus registry, so they are
+// served by Caddy's existing /metrics admin endpoint. Every metric is labeled
+// with the upstream's name, or its command if it doesn't have one.
+var (
+	processStarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: CHANNEL,
+		Name:      "process_starts_total",
+		Help:      "Number of times an upstream process has been started.",
+	}, []string{"upstream"})
+
+	idleShutdowns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: CHANNEL,
+		Name:      "idle_shutdowns_total",
+		Help:      "Number of times an upstream process has been stopped because it was idle.",
+	}, []string{"upstream"})
+
+	crashes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: CHANNEL,
+		Name:      "crashes_total",
+		Help:      "Number of times an upstream process has exited without being stopped by Caddy.",
+	}, []string{"upstream"})
+
+	restarts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: CHANNEL,
+		Name:      "restarts_total",
+		Help:      "Number of times an upstream process has been restarted by its restart policy.",
+	}, []string{"upstream"})
+
+	forcedKills = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: CHANNEL,
+		Name:      "forced_kills_total",
+		Help:      "Number of times an upstream process has been killed because it didn't exit within its termination grace period.",
+	}, []string{"upstream"})
+
+	runningProcesses = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: CHANNEL,
+		Name:      "running_processes",
+		Help:      "Number of upstream processes that are currently running.",
+	}, []string{"upstream"})
+
+	coldStartDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: CHANNEL,
+		Name:      "cold_start_duration_seconds",
+		Help:      "Time taken to start an upstream process and for it to become ready.",
+		Buckets:   prometheus.ExponentialBuckets(0.05, 2, 12),
+	}, []string{"upstream"})
+)
@@ -0,0 +1,60 @@
+//go:build linux
+
+package caddy_ondemand_upstreams
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// namespaceFlags maps the supported namespace names to their clone flags.
+var namespaceFlags = map[string]uintptr{
+	"pid":     syscall.CLONE_NEWPID,
+	"mount":   syscall.CLONE_NEWNS,
+	"network": syscall.CLONE_NEWNET,
+	"ipc":     syscall.CLONE_NEWIPC,
+	"uts":     syscall.CLONE_NEWUTS,
+	"user":    syscall.CLONE_NEWUSER,
+}
+
+// checkNamespaces returns an error if the process can't be run in the given
+// namespaces, either because a name is unknown or because Caddy doesn't have
+// the privileges needed to create them.
+func checkNamespaces(names []string) error {
+	user := false
+	for _, name := range names {
+		if _, ok := namespaceFlags[name]; !ok {
+			return fmt.Errorf("unknown namespace: %s", name)
+		}
+		if name == "user" {
+			user = true
+		}
+	}
+
+	// Without a user namespace, creating the others requires CAP_SYS_ADMIN.
+	if !user && os.Geteuid() != 0 {
+		return fmt.Errorf("caddy must run as root to use namespaces without a user namespace")
+	}
+
+	return nil
+}
+
+// setNamespaces configures cmd to run in new namespaces of the given types. If
+// a user namespace is requested, Caddy's user is mapped to root inside it.
+func setNamespaces(cmd *exec.Cmd, names []string) error {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+
+	for _, name := range names {
+		cmd.SysProcAttr.Cloneflags |= namespaceFlags[name]
+		if name == "user" {
+			cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+			cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+		}
+	}
+
+	return nil
+}
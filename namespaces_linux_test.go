@@ -0,0 +1,51 @@
+package caddy_ondemand_upstreams
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestProcessIsPIDOneInNewPIDNamespace(t *testing.T) {
+	namespaces := []string{"pid"}
+	if os.Geteuid() != 0 {
+		namespaces = append(namespaces, "user")
+	}
+
+	// Skip where namespaces can't be created, such as in some containers.
+	probe := exec.Command("true")
+	if err := setNamespaces(probe, namespaces); err != nil {
+		t.Fatal(err)
+	}
+	if err := probe.Run(); err != nil {
+		t.Skipf("can't create namespaces %v: %v", namespaces, err)
+	}
+
+	dir := t.TempDir()
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:    "echo $$ > pid; exec sleep 30",
+		Port:       1,
+		Dir:        dir,
+		Namespaces: namespaces,
+		// As PID 1, the shell ignores the interrupt, so don't wait long for it.
+		TerminationGracePeriod: caddy.Duration(100 * time.Millisecond),
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+
+	var pid string
+	waitFor(t, 5*time.Second, "the process to write its PID", func() bool {
+		b, err := os.ReadFile(filepath.Join(dir, "pid"))
+		pid = strings.TrimSpace(string(b))
+		return err == nil && pid != ""
+	})
+	if pid != "1" {
+		t.Fatalf("expected the process to be PID 1 in its namespace, got %s", pid)
+	}
+}
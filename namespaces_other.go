@@ -0,0 +1,21 @@
+//go:build !linux
+
+package caddy_ondemand_upstreams
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// checkNamespaces returns an error because namespaces are only supported on
+// Linux.
+func checkNamespaces(names []string) error {
+	return fmt.Errorf("namespaces are not supported on %s", runtime.GOOS)
+}
+
+// setNamespaces returns an error because namespaces are only supported on
+// Linux.
+func setNamespaces(cmd *exec.Cmd, names []string) error {
+	return fmt.Errorf("namespaces are not supported on %s", runtime.GOOS)
+}
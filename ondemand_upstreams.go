@@ -4,18 +4,23 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/reverseproxy"
 )
 
 // Interface guards.
 var (
 	_ caddyfile.Unmarshaler       = (*OndemandUpstreams)(nil)
+	_ caddy.Provisioner           = (*OndemandUpstreams)(nil)
 	_ caddy.Validator             = (*OndemandUpstreams)(nil)
 	_ caddy.CleanerUpper          = (*OndemandUpstreams)(nil)
 	_ reverseproxy.UpstreamSource = (*OndemandUpstreams)(nil)
@@ -23,8 +28,12 @@ var (
 
 const CHANNEL = "ondemand_upstream"
 
+// safeValue matches the values that request placeholders may be replaced with
+// in the command, so that clients can't inject shell syntax through them.
+var safeValue = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
 func init() {
-	caddy.RegisterModule(OndemandUpstreams{})
+	caddy.RegisterModule(new(OndemandUpstreams))
 }
 
 // OndemandUpstreams provides upstreams from processes that are started on demand.
@@ -32,10 +41,29 @@ func init() {
 // for starting backend services that don't always need to be running (such as
 // infrequently used applications)
 type OndemandUpstreams struct {
+	// Optional. A name for this upstream, so that other upstreams can refer to
+	// it (for example, with DependsOn). Names must be unique across the config.
+	// The name is also used to label metrics; if not set, the command is used.
+	Name string `json:"name,omitempty"`
+
+	// Optional. The names of other ondemand upstreams that must be started
+	// (and ready) before this upstream's process is started. Requests to this
+	// upstream also count as activity for its dependencies.
+	DependsOn []string `json:"depends_on,omitempty"`
+
 	// Required. A command to run to start the upstream process. The command
 	// can include a %d placeholder, which will be replaced with the value of the
 	// Port setting. If no %d placeholder is present, the Port setting must be
-	// set so that Caddy knows where to proxy requests.
+	// set so that Caddy knows where to proxy requests. When Socket is set, the
+	// command can instead include a %s placeholder, which will be replaced with
+	// the socket path.
+	//
+	// The command may also contain request placeholders, such as
+	// {http.request.host}. Each distinct resolved command is a separate
+	// tenant with its own processes, which are started, scaled, and stopped
+	// independently of the others. Since the command is run by a shell, the
+	// values of request placeholders may only contain letters, digits, '.',
+	// '_' and '-'; requests with any other value fail.
 	Command string `json:"command,omitempty"`
 
 	// StartupDelay is the amount of time to wait after starting the process
@@ -43,41 +71,209 @@ type OndemandUpstreams struct {
 	// take some time to start up. Default: 0.
 	StartupDelay caddy.Duration `json:"startup_delay,omitempty"`
 
+	// Optional. A hard limit on how long the process may spend starting up,
+	// including StartupDelay and any readiness probe. If the process is still
+	// starting when this expires, it is killed. This is a safety net in case
+	// the readiness probe is misconfigured. Also accepted as startup_timeout
+	// in the Caddyfile. Default: 5 minutes.
+	MaxStartingTime caddy.Duration `json:"max_starting_time,omitempty"`
+
+	// Optional. A probe to run after starting the process (and after
+	// StartupDelay) to determine when it is ready to accept requests. If the
+	// probe does not succeed before its timeout, the process is killed.
+	Readiness *Readiness `json:"readiness,omitempty"`
+
+	// Optional. A request to send to the process once it is ready, and the
+	// response body it must give. If the response doesn't match, the process
+	// is killed and the start fails.
+	SmokeTest *SmokeTest `json:"smoke_test,omitempty"`
+
+	// Optional. The shell (and its arguments) used to run Command, which is
+	// passed as the final argument. For example, ["bash", "-c"]. If set to
+	// ["none"], Command is split on whitespace and run directly, without a
+	// shell. Default: ["sh", "-c"], or ["cmd", "/c"] on Windows.
+	Shell []string `json:"shell,omitempty"`
+
 	// Optional. A fixed port number to use for the upstream. If this is not set
 	// in your configuration, an available port will be chosen automatically.
 	// Default: -1 (automatic port assignment)
 	Port int `json:"port,omitempty"`
 
+	// Optional. Proxy to the process over a unix socket at this path instead of
+	// a TCP port. The path can include a %d placeholder, which will be replaced
+	// with a unique number. The socket file is removed when the process stops.
+	// Cannot be used with Port.
+	Socket string `json:"socket,omitempty"`
+
 	// Optional. The working directory to use for the upstream process. If not
 	// set, the current working directory will be used.
 	Dir string `json:"dir,omitempty"`
 
+	// Optional. The user to run the process as, either a username or a numeric
+	// uid:gid pair. The user's supplementary groups are set too. Caddy must be
+	// running as root to use this. Not supported on Windows.
+	User string `json:"user,omitempty"`
+
+	// Optional. Run the process in new Linux namespaces for isolation. Supported
+	// values are "pid", "mount", "network", "ipc", "uts", and "user". Unless
+	// "user" is included, Caddy must be running as root. A process in a new
+	// network namespace can't be reached over a TCP port, so "network"
+	// requires Socket. In a new PID namespace the process runs as PID 1, which
+	// ignores SIGINT unless it handles it explicitly, so it may only be stopped
+	// once TerminationGracePeriod has passed. Only supported on Linux.
+	Namespaces []string `json:"namespaces,omitempty"`
+
 	// Optional. A list of environment variables to set for the process.
 	Env map[string]string `json:"env,omitempty"`
 
 	// Optional. The number of seconds that the process should continue running
-	// if no traffic is received. Set to -1 to disable process termination.
+	// if no traffic is received. Set to -1 (or any negative value) to disable
+	// process termination; in the Caddyfile, "-1" and "off" both do this.
 	// Default: 300 seconds.
 	IdleTimeout caddy.Duration `json:"idle_timeout,omitempty"`
 
+	// Optional. The name of a request header that marks a request as not
+	// counting towards activity. Requests with this header set are proxied as
+	// usual but don't reset the idle timeout, so that health checks and other
+	// monitoring don't keep the process running forever.
+	IgnoreActivityHeader string `json:"ignore_activity_header,omitempty"`
+
+	// Optional. What to do when the process exits without being stopped by
+	// Caddy. "never" leaves it stopped until the next request starts it again.
+	// "on_failure" restarts it if it exited with a non-zero status, and
+	// "always" restarts it regardless of exit status. Restarts only happen
+	// while the process is within its idle timeout. Default: never.
+	RestartPolicy string `json:"restart_policy,omitempty"`
+
+	// Optional. The number of times in a row that the process may be
+	// restarted after exiting unexpectedly. Once exhausted, requests fail
+	// instead of starting the process again until RestartCooldown has passed.
+	// The count resets when the process is stopped by Caddy. Only used with
+	// RestartPolicy. Default: 5.
+	MaxRestarts int `json:"max_restarts,omitempty"`
+
+	// Optional. How long requests fail for once MaxRestarts is exhausted,
+	// before the process is tried again. A process that runs for at least
+	// this long before exiting unexpectedly also starts a fresh count.
+	// Default: 5 minutes.
+	RestartCooldown caddy.Duration `json:"restart_cooldown,omitempty"`
+
+	// Optional. If true, the restart counter (including whether MaxRestarts
+	// has been exhausted, and when) is kept across config reloads for as long
+	// as Caddy is running, so that a reload doesn't restart a process that
+	// keeps crashing. A reload doesn't extend RestartCooldown. Processes are
+	// matched by their resolved command. Default: false.
+	PersistRestarts bool `json:"persist_restarts,omitempty"`
+
+	// Optional. Record activity (for the purposes of IdleTimeout) at most once
+	// per this interval, rather than on every request. This reduces contention
+	// between concurrent requests under heavy load. Should be much shorter
+	// than IdleTimeout. Default: 0 (record activity on every request).
+	ActivityInterval caddy.Duration `json:"activity_interval,omitempty"`
+
 	// Optional. The amount of time to wait for the application to gracefully
 	// shut down before killing it (after idle_timeout). Default: 10 seconds.
 	TerminationGracePeriod caddy.Duration `json:"termination_grace_period,omitempty"`
 
-	// Optional. Redirect stdout to a file. If not set, stdout will be sent to
-	// Caddy's stdout.
-	// StdoutFile string `json:"stdout_file,omitempty"`
+	// Optional. Redirect stdout to a file. The file is created if it doesn't
+	// exist and appended to if it does. Relative paths are resolved against
+	// Dir. The special values "stdout" and "stderr" send output to Caddy's
+	// stdout or stderr, and "log" sends each line to Caddy's log. If not set,
+	// stdout will be sent to Caddy's stdout.
+	StdoutFile string `json:"stdout_file,omitempty"`
+
+	// Optional. Redirect stderr to a file. The file is created if it doesn't
+	// exist and appended to if it does. Relative paths are resolved against
+	// Dir. The special values "stdout" and "stderr" send output to Caddy's
+	// stdout or stderr, and "log" sends each line to Caddy's log. If not set,
+	// stderr will be sent to Caddy's stderr.
+	StderrFile string `json:"stderr_file,omitempty"`
+
+	// Optional. How to log output lines when StdoutFile or StderrFile is
+	// "log". "text" logs each line in an output field. "json" parses each line
+	// as a JSON object and merges its keys into the log entry, falling back to
+	// text for lines that aren't JSON objects. Default: text.
+	LogFormat string `json:"log_format,omitempty"`
+
+	// Optional. The number of recent output lines to keep in memory so that
+	// they can be read with the admin API at /ondemand/<name>/logs. Requires
+	// Name to be set. Default: 0 (no lines are kept).
+	LogBuffer int `json:"log_buffer,omitempty"`
+
+	// Optional. If true, requests fail with a 503 until the process has been
+	// started (and is ready) for the first time, rather than waiting for it.
+	// The first request starts the process in the background. Once warm,
+	// requests are served normally. Default: false (requests wait for the
+	// process to start and are then proxied).
+	BlockUntilWarm bool `json:"block_until_warm,omitempty"`
+
+	// Optional. The maximum number of processes to run. Replicas are started
+	// one at a time as the number of concurrent requests rises, and each
+	// request is sent to the least busy replica. Each one is stopped
+	// independently once it is no longer needed and reaches its idle timeout.
+	// Each replica gets its own port (or socket, in which case Socket must
+	// contain a %d placeholder). Default: 1.
+	Replicas int `json:"replicas,omitempty"`
+
+	// Optional. The number of concurrent requests that each replica should
+	// handle before another replica is started, up to Replicas. For example,
+	// with a threshold of 10, a second replica is started once more than 10
+	// requests are in flight. Default: 1.
+	ScaleThreshold int `json:"scale_threshold,omitempty"`
+
+	// Optional. The maximum number of distinct commands to run processes for
+	// at once when Command contains request placeholders. Tenants whose
+	// processes have all stopped are forgotten to make room for new ones;
+	// requests for a new tenant fail with a 503 if there isn't room.
+	// Default: 100.
+	MaxTenants int `json:"max_tenants,omitempty"`
+
+	// Optional. Hosts whose tenants are kept warm: their processes aren't
+	// stopped for being idle, while other tenants' processes are stopped after
+	// IdleTimeout as usual.
+	KeepWarm []string `json:"keep_warm,omitempty"`
+
+	// The recent output of every process, if LogBuffer is set.
+	outputBuffer *outputBuffer
+
+	// The managed tenants, keyed by resolved command.
+	tenants map[string]*tenant
+	mu      sync.Mutex
 
-	// Optional. Redirect stderr to a file. If not set, stderr will be sent to
-	// Caddy's stderr.
-	// StderrFile string `json:"stderr_file,omitempty"`
+	// The requests in flight, keyed by their *caddy.Replacer, so that they
+	// can be found again if the reverse proxy retries them.
+	proxied sync.Map
+}
+
+// tenant is the set of replicas running a single resolved command.
+type tenant struct {
+	command string
+
+	// The managed upstream processes, one per replica. Guarded by the
+	// upstream's mu.
+	processes []*UpstreamProcess
+
+	// The number of callers (mostly requests in flight) using the tenant.
+	// Tenants are only forgotten when this is zero. Guarded by the upstream's
+	// mu.
+	refs int
 
-	// The managed upstream process.
-	upstreamProcess *UpstreamProcess
+	// The number of requests in flight for the tenant, which is used to start
+	// replicas as concurrent demand rises.
+	requests atomic.Int64
+
+	// Whether the process has been started successfully at least once, and
+	// whether a warmup is currently in progress.
+	warm    atomic.Bool
+	warming atomic.Bool
+
+	// Whether the tenant serves a host listed in KeepWarm, so that its
+	// processes aren't stopped for being idle.
+	keepWarm atomic.Bool
 }
 
 // CaddyModule returns the Caddy module information.
-func (OndemandUpstreams) CaddyModule() caddy.ModuleInfo {
+func (*OndemandUpstreams) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID:  "http.reverse_proxy.upstreams.ondemand",
 		New: func() caddy.Module { return new(OndemandUpstreams) },
@@ -95,6 +291,26 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 
 		for d.NextBlock(0) {
 			switch d.Val() {
+			case "name":
+				caddy.Log().Named(CHANNEL).Info("parsing name")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Name != "" {
+					return d.Err("name has already been specified")
+				}
+				o.Name = d.Val()
+				caddy.Log().Named(CHANNEL).Info("name: " + o.Name)
+
+			case "depends_on":
+				caddy.Log().Named(CHANNEL).Info("parsing depends_on")
+				names := d.RemainingArgs()
+				if len(names) == 0 {
+					return d.ArgErr()
+				}
+				o.DependsOn = append(o.DependsOn, names...)
+				caddy.Log().Named(CHANNEL).Info("depends_on: " + strings.Join(names, " "))
+
 			case "command":
 				caddy.Log().Named(CHANNEL).Info("parsing command")
 				if !d.NextArg() {
@@ -121,6 +337,28 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				o.Port = i
 				caddy.Log().Named(CHANNEL).Info("port: " + d.Val())
 
+			case "socket":
+				caddy.Log().Named(CHANNEL).Info("parsing socket")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Socket != "" {
+					return d.Err("socket has already been specified")
+				}
+				o.Socket = d.Val()
+				caddy.Log().Named(CHANNEL).Info("socket: " + o.Socket)
+
+			case "shell":
+				caddy.Log().Named(CHANNEL).Info("parsing shell")
+				if len(o.Shell) > 0 {
+					return d.Err("shell has already been specified")
+				}
+				o.Shell = d.RemainingArgs()
+				if len(o.Shell) == 0 {
+					return d.ArgErr()
+				}
+				caddy.Log().Named(CHANNEL).Info("shell: " + strings.Join(o.Shell, " "))
+
 			case "dir":
 				caddy.Log().Named(CHANNEL).Info("parsing dir")
 				if !d.NextArg() {
@@ -132,6 +370,32 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				o.Dir = d.Val()
 				caddy.Log().Named(CHANNEL).Info("dir: " + o.Dir)
 
+			case "user":
+				caddy.Log().Named(CHANNEL).Info("parsing user")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.User != "" {
+					return d.Err("user has already been specified")
+				}
+				o.User = d.Val()
+				caddy.Log().Named(CHANNEL).Info("user: " + o.User)
+
+			case "namespaces":
+				caddy.Log().Named(CHANNEL).Info("parsing namespaces")
+				args := d.RemainingArgs()
+				if len(args) == 0 {
+					return d.ArgErr()
+				}
+				for _, arg := range args {
+					for _, name := range strings.Split(arg, ",") {
+						if name != "" {
+							o.Namespaces = append(o.Namespaces, name)
+						}
+					}
+				}
+				caddy.Log().Named(CHANNEL).Info("namespaces: " + strings.Join(o.Namespaces, ","))
+
 			case "env":
 				caddy.Log().Named(CHANNEL).Info("parsing env")
 				var envKey, envValue string
@@ -149,6 +413,65 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				}
 				o.Env[envKey] = envValue
 
+			case "log_buffer":
+				caddy.Log().Named(CHANNEL).Info("parsing log_buffer")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.LogBuffer != 0 {
+					return d.Err("log_buffer has already been specified")
+				}
+				i, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid log_buffer: %v", err)
+				}
+				o.LogBuffer = i
+				caddy.Log().Named(CHANNEL).Info("log_buffer: " + d.Val())
+
+			case "ignore_activity_header":
+				caddy.Log().Named(CHANNEL).Info("parsing ignore_activity_header")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.IgnoreActivityHeader != "" {
+					return d.Err("ignore_activity_header has already been specified")
+				}
+				o.IgnoreActivityHeader = d.Val()
+				caddy.Log().Named(CHANNEL).Info("ignore_activity_header: " + o.IgnoreActivityHeader)
+
+			case "stdout_file":
+				caddy.Log().Named(CHANNEL).Info("parsing stdout_file")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.StdoutFile != "" {
+					return d.Err("stdout_file has already been specified")
+				}
+				o.StdoutFile = d.Val()
+				caddy.Log().Named(CHANNEL).Info("stdout_file: " + o.StdoutFile)
+
+			case "stderr_file":
+				caddy.Log().Named(CHANNEL).Info("parsing stderr_file")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.StderrFile != "" {
+					return d.Err("stderr_file has already been specified")
+				}
+				o.StderrFile = d.Val()
+				caddy.Log().Named(CHANNEL).Info("stderr_file: " + o.StderrFile)
+
+			case "log_format":
+				caddy.Log().Named(CHANNEL).Info("parsing log_format")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.LogFormat != "" {
+					return d.Err("log_format has already been specified")
+				}
+				o.LogFormat = d.Val()
+				caddy.Log().Named(CHANNEL).Info("log_format: " + o.LogFormat)
+
 			case "startup_delay":
 				caddy.Log().Named(CHANNEL).Info("parsing startup_delay")
 				if !d.NextArg() {
@@ -164,6 +487,134 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				o.StartupDelay = caddy.Duration(dur)
 				caddy.Log().Named(CHANNEL).Info("startup_delay: " + d.Val())
 
+			// startup_timeout is an alias for max_starting_time.
+			case "max_starting_time", "startup_timeout":
+				caddy.Log().Named(CHANNEL).Info("parsing max_starting_time")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.MaxStartingTime != 0 {
+					return d.Err("max_starting_time (or startup_timeout) has already been specified")
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %v", err)
+				}
+				o.MaxStartingTime = caddy.Duration(dur)
+				caddy.Log().Named(CHANNEL).Info("max_starting_time: " + d.Val())
+
+			case "readiness":
+				caddy.Log().Named(CHANNEL).Info("parsing readiness")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Readiness == nil {
+					o.Readiness = new(Readiness)
+				}
+				if o.Readiness.Mode != "" {
+					return d.Err("readiness has already been specified")
+				}
+				o.Readiness.Mode = d.Val()
+				switch o.Readiness.Mode {
+				case "tcp":
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "http":
+					if d.NextArg() {
+						o.Readiness.Path = d.Val()
+					}
+					if d.NextArg() {
+						status, err := strconv.Atoi(d.Val())
+						if err != nil {
+							return d.Errf("invalid status code: %v", err)
+						}
+						o.Readiness.Status = status
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				case "file":
+					if !d.NextArg() {
+						return d.ArgErr()
+					}
+					o.Readiness.File = d.Val()
+					if d.NextArg() {
+						return d.ArgErr()
+					}
+				default:
+					return d.Errf("unknown readiness mode: %s", o.Readiness.Mode)
+				}
+				caddy.Log().Named(CHANNEL).Info("readiness: " + o.Readiness.Mode)
+
+			case "smoke_test":
+				caddy.Log().Named(CHANNEL).Info("parsing smoke_test")
+				if o.SmokeTest != nil {
+					return d.Err("smoke_test has already been specified")
+				}
+				args := d.RemainingArgs()
+				o.SmokeTest = new(SmokeTest)
+				if len(args) == 4 {
+					o.SmokeTest.Method = strings.ToUpper(args[0])
+					args = args[1:]
+				}
+				if len(args) != 3 || args[1] != "expect" {
+					return d.Err("expected smoke_test [method] <path> expect <pattern>")
+				}
+				o.SmokeTest.Path = args[0]
+				o.SmokeTest.Expect = args[2]
+				caddy.Log().Named(CHANNEL).Info("smoke_test: " + o.SmokeTest.Path + " expect " + o.SmokeTest.Expect)
+
+			case "ready_file_content":
+				caddy.Log().Named(CHANNEL).Info("parsing ready_file_content")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Readiness == nil {
+					o.Readiness = new(Readiness)
+				}
+				if o.Readiness.FileContent != "" {
+					return d.Err("ready_file_content has already been specified")
+				}
+				o.Readiness.FileContent = d.Val()
+				caddy.Log().Named(CHANNEL).Info("ready_file_content: " + o.Readiness.FileContent)
+
+			case "readiness_interval":
+				caddy.Log().Named(CHANNEL).Info("parsing readiness_interval")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Readiness == nil {
+					o.Readiness = new(Readiness)
+				}
+				if o.Readiness.Interval != 0 {
+					return d.Err("readiness_interval has already been specified")
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %v", err)
+				}
+				o.Readiness.Interval = caddy.Duration(dur)
+				caddy.Log().Named(CHANNEL).Info("readiness_interval: " + d.Val())
+
+			case "readiness_timeout":
+				caddy.Log().Named(CHANNEL).Info("parsing readiness_timeout")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Readiness == nil {
+					o.Readiness = new(Readiness)
+				}
+				if o.Readiness.Timeout != 0 {
+					return d.Err("readiness_timeout has already been specified")
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %v", err)
+				}
+				o.Readiness.Timeout = caddy.Duration(dur)
+				caddy.Log().Named(CHANNEL).Info("readiness_timeout: " + d.Val())
+
 			case "termination_grace_period":
 				caddy.Log().Named(CHANNEL).Info("parsing termination_grace_period")
 				if !d.NextArg() {
@@ -179,6 +630,137 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				o.TerminationGracePeriod = caddy.Duration(dur)
 				caddy.Log().Named(CHANNEL).Info("termination_grace_period: " + d.Val())
 
+			case "restart_cooldown":
+				caddy.Log().Named(CHANNEL).Info("parsing restart_cooldown")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.RestartCooldown != 0 {
+					return d.Err("restart_cooldown has already been specified")
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %v", err)
+				}
+				o.RestartCooldown = caddy.Duration(dur)
+				caddy.Log().Named(CHANNEL).Info("restart_cooldown: " + d.Val())
+
+			case "replicas":
+				caddy.Log().Named(CHANNEL).Info("parsing replicas")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.Replicas != 0 {
+					return d.Err("replicas has already been specified")
+				}
+				i, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid replicas: %v", err)
+				}
+				o.Replicas = i
+				caddy.Log().Named(CHANNEL).Info("replicas: " + d.Val())
+
+			case "scale_threshold":
+				caddy.Log().Named(CHANNEL).Info("parsing scale_threshold")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.ScaleThreshold != 0 {
+					return d.Err("scale_threshold has already been specified")
+				}
+				i, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid scale_threshold: %v", err)
+				}
+				o.ScaleThreshold = i
+				caddy.Log().Named(CHANNEL).Info("scale_threshold: " + d.Val())
+
+			case "max_tenants":
+				caddy.Log().Named(CHANNEL).Info("parsing max_tenants")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.MaxTenants != 0 {
+					return d.Err("max_tenants has already been specified")
+				}
+				i, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_tenants: %v", err)
+				}
+				o.MaxTenants = i
+				caddy.Log().Named(CHANNEL).Info("max_tenants: " + d.Val())
+
+			case "keep_warm":
+				caddy.Log().Named(CHANNEL).Info("parsing keep_warm")
+				hosts := d.RemainingArgs()
+				if len(hosts) == 0 {
+					return d.ArgErr()
+				}
+				o.KeepWarm = append(o.KeepWarm, hosts...)
+				caddy.Log().Named(CHANNEL).Info("keep_warm: " + strings.Join(hosts, " "))
+
+			case "restart_policy":
+				caddy.Log().Named(CHANNEL).Info("parsing restart_policy")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.RestartPolicy != "" {
+					return d.Err("restart_policy has already been specified")
+				}
+				o.RestartPolicy = d.Val()
+				caddy.Log().Named(CHANNEL).Info("restart_policy: " + o.RestartPolicy)
+
+			case "max_restarts":
+				caddy.Log().Named(CHANNEL).Info("parsing max_restarts")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.MaxRestarts != 0 {
+					return d.Err("max_restarts has already been specified")
+				}
+				i, err := strconv.Atoi(d.Val())
+				if err != nil {
+					return d.Errf("invalid max_restarts: %v", err)
+				}
+				o.MaxRestarts = i
+				caddy.Log().Named(CHANNEL).Info("max_restarts: " + d.Val())
+
+			case "persist_restarts":
+				caddy.Log().Named(CHANNEL).Info("parsing persist_restarts")
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.PersistRestarts = true
+
+			case "block_until_warm":
+				caddy.Log().Named(CHANNEL).Info("parsing block_until_warm")
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.BlockUntilWarm = true
+
+			case "serve_during_warm":
+				caddy.Log().Named(CHANNEL).Info("parsing serve_during_warm")
+				if d.NextArg() {
+					return d.ArgErr()
+				}
+				o.BlockUntilWarm = false
+
+			case "activity_interval":
+				caddy.Log().Named(CHANNEL).Info("parsing activity_interval")
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				if o.ActivityInterval != 0 {
+					return d.Err("activity_interval has already been specified")
+				}
+				dur, err := caddy.ParseDuration(d.Val())
+				if err != nil {
+					return d.Errf("invalid duration: %v", err)
+				}
+				o.ActivityInterval = caddy.Duration(dur)
+				caddy.Log().Named(CHANNEL).Info("activity_interval: " + d.Val())
+
 			case "idle_timeout":
 				caddy.Log().Named(CHANNEL).Info("parsing idle_timeout")
 				if !d.NextArg() {
@@ -187,10 +769,18 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				if o.IdleTimeout != 0 {
 					return d.Err("idle_timeout has already been specified")
 				}
+				if d.Val() == "-1" || d.Val() == "off" {
+					o.IdleTimeout = caddy.Duration(-1)
+					caddy.Log().Named(CHANNEL).Info("idle_timeout: off")
+					break
+				}
 				dur, err := caddy.ParseDuration(d.Val())
 				if err != nil {
 					return d.Errf("invalid duration: %v", err)
 				}
+				if dur <= 0 {
+					return d.Errf("idle_timeout must be positive, or -1 or off to disable")
+				}
 				o.IdleTimeout = caddy.Duration(dur)
 				caddy.Log().Named(CHANNEL).Info("idle_timeout: " + d.Val())
 			}
@@ -200,6 +790,15 @@ func (o *OndemandUpstreams) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// Provision implements caddy.Provisioner.
+func (o *OndemandUpstreams) Provision(ctx caddy.Context) error {
+	if o.LogBuffer > 0 {
+		o.outputBuffer = newOutputBuffer(o.LogBuffer)
+	}
+	registerUpstream(o)
+	return nil
+}
+
 // Validate implements caddy.Validator.
 func (o *OndemandUpstreams) Validate() error {
 	caddy.Log().Named(CHANNEL).Info("ondemand_upstream validate")
@@ -208,9 +807,25 @@ func (o *OndemandUpstreams) Validate() error {
 		return fmt.Errorf("command is required")
 	}
 
+	for _, name := range o.DependsOn {
+		if name == o.Name {
+			return fmt.Errorf("upstream cannot depend on itself")
+		}
+	}
+
+	// A negative idle timeout means the process is never stopped for being
+	// idle, so only an unset (zero) value gets the default.
 	if o.IdleTimeout == caddy.Duration(0) {
 		o.IdleTimeout = caddy.Duration(300 * time.Second)
 		caddy.Log().Named(CHANNEL).Info("idle_timeout: " + fmt.Sprint(o.IdleTimeout))
+	} else if o.IdleTimeout < 0 {
+		o.IdleTimeout = caddy.Duration(-1)
+		caddy.Log().Named(CHANNEL).Info("idle_timeout: off")
+	}
+
+	if o.MaxStartingTime == caddy.Duration(0) {
+		o.MaxStartingTime = caddy.Duration(5 * time.Minute)
+		caddy.Log().Named(CHANNEL).Info("max_starting_time: " + fmt.Sprint(o.MaxStartingTime))
 	}
 
 	if o.TerminationGracePeriod == caddy.Duration(0) {
@@ -218,10 +833,116 @@ func (o *OndemandUpstreams) Validate() error {
 		caddy.Log().Named(CHANNEL).Info("termination_grace_period: " + fmt.Sprint(o.TerminationGracePeriod))
 	}
 
-	if o.Port == 0 {
-		o.Port = -1
+	if o.Readiness != nil {
+		if o.Readiness.Mode == "" {
+			return fmt.Errorf("readiness_interval, readiness_timeout, and ready_file_content require readiness to be set")
+		}
+		if err := o.Readiness.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.SmokeTest != nil {
+		if err := o.SmokeTest.Validate(); err != nil {
+			return err
+		}
+	}
+
+	if o.User != "" {
+		if err := checkUser(o.User); err != nil {
+			return err
+		}
+	}
+
+	if len(o.Namespaces) > 0 {
+		if err := checkNamespaces(o.Namespaces); err != nil {
+			return err
+		}
+		for _, name := range o.Namespaces {
+			if name == "network" && o.Socket == "" {
+				return fmt.Errorf("the network namespace requires socket to be set")
+			}
+		}
+	}
+
+	switch o.LogFormat {
+	case "":
+		o.LogFormat = "text"
+	case "text", "json":
+	default:
+		return fmt.Errorf("unknown log_format: %s", o.LogFormat)
+	}
+
+	if o.LogBuffer < 0 {
+		return fmt.Errorf("log_buffer cannot be negative")
+	}
+	if o.LogBuffer > 0 && o.Name == "" {
+		return fmt.Errorf("log_buffer requires name to be set")
+	}
+
+	switch o.RestartPolicy {
+	case "":
+		o.RestartPolicy = "never"
+	case "never", "on_failure", "always":
+	default:
+		return fmt.Errorf("unknown restart_policy: %s", o.RestartPolicy)
+	}
+
+	if o.MaxRestarts < 0 {
+		return fmt.Errorf("max_restarts cannot be negative")
+	}
+	if o.MaxRestarts == 0 {
+		o.MaxRestarts = 5
+	}
+
+	if o.RestartCooldown < 0 {
+		return fmt.Errorf("restart_cooldown cannot be negative")
+	}
+	if o.RestartCooldown == 0 {
+		o.RestartCooldown = caddy.Duration(5 * time.Minute)
+		caddy.Log().Named(CHANNEL).Info("restart_cooldown: " + fmt.Sprint(o.RestartCooldown))
+	}
+
+	if o.Socket != "" && o.Port != 0 {
+		return fmt.Errorf("port and socket cannot both be set")
+	}
+
+	if o.Replicas < 0 {
+		return fmt.Errorf("replicas cannot be negative")
+	}
+	if o.Replicas == 0 {
+		o.Replicas = 1
+	}
+	if o.ScaleThreshold < 0 {
+		return fmt.Errorf("scale_threshold cannot be negative")
+	}
+	if o.ScaleThreshold == 0 {
+		o.ScaleThreshold = 1
+	}
+	if o.MaxTenants < 0 {
+		return fmt.Errorf("max_tenants cannot be negative")
+	}
+	if o.MaxTenants == 0 {
+		o.MaxTenants = 100
+	}
+	if o.Replicas > 1 {
+		if o.Port > 0 {
+			return fmt.Errorf("port cannot be set when using more than one replica")
+		}
+		if o.Socket != "" && !strings.Contains(o.Socket, "%d") {
+			return fmt.Errorf("socket must contain a %%d placeholder when using more than one replica")
+		}
+		if o.Readiness != nil && o.Readiness.Mode == "file" && !strings.Contains(o.Readiness.File, o.placeholder()) {
+			return fmt.Errorf("readiness file must contain a %s placeholder when using more than one replica", o.placeholder())
+		}
+	}
+
+	if o.Socket == "" {
+		if o.Port == 0 {
+			o.Port = -1
+		}
+		caddy.Log().Named(CHANNEL).Info("port: " + strconv.Itoa(o.Port))
 	}
-	caddy.Log().Named(CHANNEL).Info("port: " + strconv.Itoa(o.Port))
 
 	return nil
 }
@@ -230,30 +951,591 @@ func (o *OndemandUpstreams) Validate() error {
 func (o *OndemandUpstreams) GetUpstreams(r *http.Request) ([]*reverseproxy.Upstream, error) {
 	caddy.Log().Named(CHANNEL).Info("ondemand_upstream get upstreams")
 
-	if o.upstreamProcess == nil {
+	repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return nil, fmt.Errorf("no replacer in request context")
+	}
+
+	// The reverse proxy asks for upstreams again if it retries the request.
+	if v, ok := o.proxied.Load(repl); ok {
+		pr := v.(*proxiedRequest)
+		return pr.upstreams(int(pr.t.requests.Load()))
+	}
+
+	command, err := o.command(r)
+	if err != nil {
+		return nil, err
+	}
+	t, err := o.acquire(command)
+	if err != nil {
+		return nil, err
+	}
+	if o.keepsWarm(r) {
+		t.keepWarm.Store(true)
+	}
+
+	if o.BlockUntilWarm && !t.warm.Load() {
+		// Only the first request kicks off the warmup; everything else is
+		// turned away until it's done.
+		if t.warming.CompareAndSwap(false, true) {
+			go func() {
+				defer o.release(t)
+				defer t.warming.Store(false)
+				if _, err := o.start(nil, t, 1); err != nil {
+					caddy.Log().Named(CHANNEL).Info("error while warming up upstream: " + fmt.Sprint(err))
+					return
+				}
+				t.warm.Store(true)
+			}()
+		} else {
+			o.release(t)
+		}
+		return nil, caddyhttp.Error(http.StatusServiceUnavailable, fmt.Errorf("upstream is warming up"))
+	}
+
+	demand := int(t.requests.Add(1))
+	pr := &proxiedRequest{
+		o:        o,
+		t:        t,
+		activity: o.IgnoreActivityHeader == "" || r.Header.Get(o.IgnoreActivityHeader) == "",
+	}
+	upstreams, err := pr.upstreams(demand)
+	if err != nil {
+		t.requests.Add(-1)
+		o.release(t)
+		return nil, err
+	}
+	repl.Map(pr.dial)
+
+	// The request is tracked until it's done, so that the replica it's sent
+	// to isn't stopped for being idle in the meantime. The request's context
+	// is done once the request has been handled.
+	if done := r.Context().Done(); done != nil {
+		o.proxied.Store(repl, pr)
+		go func() {
+			<-done
+			o.proxied.Delete(repl)
+			pr.finish()
+		}()
+	} else {
+		pr.finish()
+	}
+
+	return upstreams, nil
+}
+
+// proxiedRequest tracks a request through the reverse proxy. Every ready
+// replica is handed to the reverse proxy as a placeholder, so that its load
+// balancing policy can pick one; the request is only counted against that
+// replica once the reverse proxy resolves the placeholder to dial it.
+type proxiedRequest struct {
+	o        *OndemandUpstreams
+	t        *tenant
+	activity bool
+
+	mu         sync.Mutex
+	candidates []*UpstreamProcess
+	picked     *UpstreamProcess
+	done       bool
+}
+
+// upstreams makes sure that enough replicas are running for the given demand
+// and returns the ready ones for the reverse proxy to pick from. It's called
+// again if the reverse proxy retries the request, in which case the replica
+// picked last time is no longer serving the request.
+func (pr *proxiedRequest) upstreams(demand int) ([]*reverseproxy.Upstream, error) {
+	processes, err := pr.o.start(nil, pr.t, demand)
+	if err != nil {
+		return nil, err
+	}
+	pr.t.warm.Store(true)
+
+	candidates := readyReplicas(processes, pr.o.wanted(demand))
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no upstreams available")
+	}
+
+	pr.mu.Lock()
+	pr.candidates = candidates
+	if pr.picked != nil {
+		pr.picked.RequestFinished(false)
+		pr.picked = nil
+	}
+	pr.mu.Unlock()
+
+	upstreams := make([]*reverseproxy.Upstream, 0, len(candidates))
+	for _, process := range candidates {
+		upstreams = append(upstreams, &reverseproxy.Upstream{Dial: "{" + process.dialKey() + "}"})
+	}
+	return upstreams, nil
+}
+
+// dial is a caddy.ReplacerFunc that resolves the placeholder of the replica
+// picked by the reverse proxy to its address, and counts the request against
+// it. A replica that the idle timeout has just decided to stop won't take the
+// request, so another one is used instead, starting one if needed.
+func (pr *proxiedRequest) dial(key string) (any, bool) {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	var picked *UpstreamProcess
+	for _, process := range pr.candidates {
+		if process.dialKey() == key {
+			picked = process
+			break
+		}
+	}
+	if picked == nil {
+		return nil, false
+	}
+
+	// Once the request is done, there's nothing left to count.
+	if pr.done {
+		return picked.Info().Dial, true
+	}
+
+	if pr.picked != nil {
+		pr.picked.RequestFinished(false)
+		pr.picked = nil
+	}
+	candidates := append([]*UpstreamProcess{picked}, pr.candidates...)
+	for {
+		for _, process := range candidates {
+			if pr.take(process) {
+				dial := process.Info().Dial
+				caddy.Log().Named(CHANNEL).Info("sending req to " + dial)
+				return dial, true
+			}
+		}
+
+		demand := int(pr.t.requests.Load())
+		processes, err := pr.o.start(nil, pr.t, demand)
+		if err != nil {
+			caddy.Log().Named(CHANNEL).Info("error while starting upstream: " + fmt.Sprint(err))
+			return "", true
+		}
+		candidates = readyReplicas(processes, pr.o.wanted(demand))
+		if len(candidates) == 0 {
+			caddy.Log().Named(CHANNEL).Info("no upstreams available")
+			return "", true
+		}
+		pr.candidates = candidates
+	}
+}
+
+// take counts the request against the given replica if it will take it. The
+// caller must hold pr.mu.
+func (pr *proxiedRequest) take(process *UpstreamProcess) bool {
+	if !process.RequestStarted() {
+		return false
+	}
+	if !process.IsReady() {
+		process.RequestFinished(false)
+		return false
+	}
+	if pr.activity {
+		process.LogActivity()
+	}
+	pr.picked = process
+	return true
+}
+
+// finish records that the request is done.
+func (pr *proxiedRequest) finish() {
+	pr.mu.Lock()
+	defer pr.mu.Unlock()
+
+	pr.done = true
+	if pr.picked != nil {
+		pr.picked.RequestFinished(pr.activity)
+		pr.picked = nil
+	}
+	pr.t.requests.Add(-1)
+	pr.o.release(pr.t)
+}
+
+// keepsWarm reports whether the request's host is listed in KeepWarm.
+func (o *OndemandUpstreams) keepsWarm(r *http.Request) bool {
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	for _, h := range o.KeepWarm {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// readyReplicas returns the wanted replicas that are ready. Replicas that are
+// no longer needed for the current demand are left out, so that they reach
+// their idle timeout and shut down, unless none of the wanted replicas are
+// ready; then the first ready replica is returned.
+func readyReplicas(processes []*UpstreamProcess, wanted int) []*UpstreamProcess {
+	var ready []*UpstreamProcess
+	for i, process := range processes {
+		if i >= wanted && len(ready) > 0 {
+			break
+		}
+		if process.IsReady() {
+			ready = append(ready, process)
+		}
+	}
+	return ready
+}
+
+// command returns Command with any placeholders resolved for the given
+// request. If r is nil, only global placeholders are resolved. Unknown
+// placeholders are left alone so that shell syntax like ${VAR} survives. An
+// error is returned if a request placeholder's value isn't safe to pass to the
+// shell.
+func (o *OndemandUpstreams) command(r *http.Request) (string, error) {
+	var repl *caddy.Replacer
+	if r != nil {
+		repl, _ = r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	}
+	if repl == nil {
+		repl = caddy.NewReplacer()
+	}
+
+	// Values end up in the format string for the port or socket placeholder,
+	// so any % in them has to be escaped.
+	escape := strings.Contains(o.Command, o.placeholder())
+
+	var b strings.Builder
+	rest := o.Command
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			break
+		}
+		key := rest[open+1 : open+end]
+
+		val, ok := repl.Get(key)
+		if !ok {
+			b.WriteString(rest[:open+1])
+			rest = rest[open+1:]
+			continue
+		}
+		value := ""
+		if val != nil {
+			value = fmt.Sprint(val)
+		}
+		if strings.HasPrefix(key, "http.") && !safeValue.MatchString(value) {
+			return "", fmt.Errorf("placeholder {%s} has a value that can't be used in the command: %q", key, value)
+		}
+		if escape {
+			value = strings.ReplaceAll(value, "%", "%%")
+		}
+
+		b.WriteString(rest[:open])
+		b.WriteString(value)
+		rest = rest[open+end+1:]
+	}
+	b.WriteString(rest)
+
+	return b.String(), nil
+}
+
+// acquire returns the tenant for the given resolved command, creating it if
+// needed, and records that the caller is using it so that it isn't forgotten.
+// Every successful call must be paired with a call to release.
+func (o *OndemandUpstreams) acquire(command string) (*tenant, error) {
+	o.mu.Lock()
+	if _, ok := o.tenants[command]; !ok && len(o.tenants) >= o.MaxTenants {
+		o.mu.Unlock()
+		o.evictIdleTenants()
+		o.mu.Lock()
+	}
+	defer o.mu.Unlock()
+
+	t, ok := o.tenants[command]
+	if !ok {
+		if len(o.tenants) >= o.MaxTenants {
+			return nil, fmt.Errorf("too many tenants running; max_tenants is %d", o.MaxTenants)
+		}
+		if len(o.tenants) > 0 && (o.Port > 0 || (o.Socket != "" && !strings.Contains(o.Socket, "%d"))) {
+			return nil, fmt.Errorf("port cannot be set, and socket must contain a %%d placeholder, to run more than one tenant")
+		}
+		if o.tenants == nil {
+			o.tenants = make(map[string]*tenant)
+		}
+		t = &tenant{command: command}
+		o.tenants[command] = t
+	}
+	t.refs++
+
+	return t, nil
+}
+
+// release records that a caller is done with a tenant returned by acquire.
+func (o *OndemandUpstreams) release(t *tenant) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	t.refs--
+}
+
+// evictIdleTenants forgets every tenant that nobody is using and whose
+// processes have all stopped, to make room for new tenants.
+func (o *OndemandUpstreams) evictIdleTenants() {
+	o.mu.Lock()
+	candidates := make(map[*tenant][]*UpstreamProcess)
+	for _, t := range o.tenants {
+		if t.refs == 0 {
+			candidates[t] = append([]*UpstreamProcess(nil), t.processes...)
+		}
+	}
+	o.mu.Unlock()
+
+	// Checking whether a process is idle waits for it if it's being stopped,
+	// so don't hold the lock while doing so.
+	var idle []*tenant
+	for t, processes := range candidates {
+		isIdle := true
+		for _, process := range processes {
+			if !process.IsIdle() {
+				isIdle = false
+				break
+			}
+		}
+		if isIdle {
+			idle = append(idle, t)
+		}
+	}
+
+	o.mu.Lock()
+	var evicted []*tenant
+	for _, t := range idle {
+		if t.refs == 0 && o.tenants[t.command] == t {
+			delete(o.tenants, t.command)
+			evicted = append(evicted, t)
+		}
+	}
+	o.mu.Unlock()
+
+	for _, t := range evicted {
+		caddy.Log().Named(CHANNEL).Info("forgetting idle tenant: " + t.command)
+		for _, process := range candidates[t] {
+			process.Stop()
+			process.RemoveSocket()
+		}
+	}
+}
+
+// start makes sure that enough of the tenant's replicas are running for the
+// given demand (the number of requests in flight), after starting any
+// upstreams that this one depends on. It returns every replica that has been
+// created, whether or not it's running. chain holds the names of the upstreams
+// that are waiting on this one, and is used to detect dependency cycles. The
+// caller must have acquired t.
+func (o *OndemandUpstreams) start(chain []string, t *tenant, demand int) ([]*UpstreamProcess, error) {
+	chain = append(chain, o.Name)
+	for _, name := range o.DependsOn {
+		for _, n := range chain {
+			if n == name {
+				return nil, fmt.Errorf("dependency cycle: %s -> %s", strings.Join(chain, " -> "), name)
+			}
+		}
+
+		dep, ok := lookupUpstream(name)
+		if !ok {
+			return nil, fmt.Errorf("dependency not found: %s", name)
+		}
+
+		caddy.Log().Named(CHANNEL).Info("starting dependency " + name)
+		depCommand, err := dep.command(nil)
+		if err != nil {
+			return nil, fmt.Errorf("starting dependency %s: %v", name, err)
+		}
+		depTenant, err := dep.acquire(depCommand)
+		if err != nil {
+			return nil, fmt.Errorf("starting dependency %s: %v", name, err)
+		}
+		depProcesses, err := dep.start(chain, depTenant, 1)
+		dep.release(depTenant)
+		if err != nil {
+			return nil, fmt.Errorf("starting dependency %s: %v", name, err)
+		}
+		depProcesses[0].LogActivity()
+	}
+
+	wanted := o.wanted(demand)
+	processes := o.replicas(t, wanted)
+
+	// If nothing is ready, the request has to wait for the first replica.
+	// Start() is a no-op if the process is already running, and starts a fresh
+	// process if the previous one exited on its own. Concurrent requests for a
+	// cold upstream all wait on the same startup. Replicas are checked without
+	// waiting on them, so a replica that's starting in the background doesn't
+	// hold up requests that the others can serve.
+	anyReady := false
+	for _, process := range processes {
+		if process.IsReady() {
+			anyReady = true
+			break
+		}
+	}
+	if !anyReady {
+		if err := processes[0].Start(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Any other replicas that are needed are started in the background, so
+	// that requests can be served by the replicas that are already running.
+	// The tenant is held until they're started so that it isn't forgotten in
+	// the meantime.
+	for _, process := range processes[:wanted] {
+		if process.IsReady() || process.IsStarting() {
+			continue
+		}
+		o.mu.Lock()
+		t.refs++
+		o.mu.Unlock()
+		go func(process *UpstreamProcess) {
+			defer o.release(t)
+			if err := process.Start(); err != nil {
+				caddy.Log().Named(CHANNEL).Info("error while starting replica: " + fmt.Sprint(err))
+			}
+		}(process)
+	}
+
+	return processes, nil
+}
+
+// replicas returns the tenant's processes, after creating any that are needed
+// to have at least n.
+func (o *OndemandUpstreams) replicas(t *tenant, n int) []*UpstreamProcess {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	idleTimeout := time.Duration(o.IdleTimeout)
+	if t.keepWarm.Load() {
+		idleTimeout = -1
+	}
+	for len(t.processes) < n {
 		// Create a new upstream process.
-		o.upstreamProcess = NewUpstreamProcess(o.Command, o.Port, o.Dir, o.Env, time.Duration(o.StartupDelay), time.Duration(o.IdleTimeout), time.Duration(o.TerminationGracePeriod))
+		process := NewUpstreamProcess(o.label(), t.command, o.Shell, o.Port, o.Socket, o.Dir, o.User, o.Namespaces, o.Env, o.StdoutFile, o.StderrFile, o.LogFormat, o.outputBuffer, time.Duration(o.StartupDelay), o.Readiness, o.SmokeTest, time.Duration(o.MaxStartingTime), idleTimeout, time.Duration(o.TerminationGracePeriod), o.RestartPolicy, o.MaxRestarts, time.Duration(o.RestartCooldown), time.Duration(o.ActivityInterval))
+		if o.PersistRestarts {
+			process.PersistRestarts(t.command + "#" + strconv.Itoa(len(t.processes)))
+		}
+		t.processes = append(t.processes, process)
 	}
 
-	o.upstreamProcess.Start()
+	return append([]*UpstreamProcess(nil), t.processes...)
+}
 
-	if o.upstreamProcess.IsRunning() {
-		o.upstreamProcess.LogActivity()
-		caddy.Log().Named(CHANNEL).Info("sending req to port " + fmt.Sprint(o.upstreamProcess.GetPort()))
-		return []*reverseproxy.Upstream{
-			{
-				Dial: net.JoinHostPort("localhost", strconv.Itoa(o.upstreamProcess.GetPort())),
-			},
-		}, nil
+// wanted returns the number of replicas needed to serve the given number of
+// requests in flight, given that each replica should handle ScaleThreshold
+// requests at a time.
+func (o *OndemandUpstreams) wanted(demand int) int {
+	n := (demand + o.ScaleThreshold - 1) / o.ScaleThreshold
+	if n < 1 {
+		return 1
+	}
+	if n > o.Replicas {
+		return o.Replicas
 	}
+	return n
+}
 
-	return nil, fmt.Errorf("no upstreams available")
+// placeholder returns the placeholder that is replaced with each process's
+// address in the command: %s for the socket path, or %d for the port.
+func (o *OndemandUpstreams) placeholder() string {
+	if o.Socket != "" {
+		return "%s"
+	}
+	return "%d"
+}
+
+// label returns the name used to identify this upstream in metrics.
+func (o *OndemandUpstreams) label() string {
+	if o.Name != "" {
+		return o.Name
+	}
+	return o.Command
+}
+
+// Prewarm starts the upstream's process, if it isn't already running, so that
+// the next request doesn't have to wait for it. Starting it explicitly ends
+// any current run of unexpected exits, so a process that was given up on is
+// tried again. It returns an error if Command contains request placeholders,
+// since there's no request to resolve them for.
+func (o *OndemandUpstreams) Prewarm() error {
+	if strings.Contains(o.Command, "{http.") {
+		return fmt.Errorf("command contains request placeholders, so its processes can only be started by requests")
+	}
+
+	command, err := o.command(nil)
+	if err != nil {
+		return err
+	}
+	t, err := o.acquire(command)
+	if err != nil {
+		return err
+	}
+	defer o.release(t)
+
+	o.replicas(t, 1)[0].ResetRestarts()
+	if _, err := o.start(nil, t, 1); err != nil {
+		return err
+	}
+	t.warm.Store(true)
+
+	return nil
+}
+
+// StopProcesses stops the upstream's running processes, or only the one with
+// the given PID if pid is not 0. It returns the number of processes stopped.
+// They're started again as usual by the next request, including processes
+// that had been given up on for exiting too many times.
+func (o *OndemandUpstreams) StopProcesses(pid int) int {
+	o.mu.Lock()
+	var processes []*UpstreamProcess
+	for _, t := range o.tenants {
+		processes = append(processes, t.processes...)
+	}
+	o.mu.Unlock()
+
+	stopped := 0
+	for _, process := range processes {
+		info := process.Info()
+		if pid != 0 && (!info.Running || info.PID != pid) {
+			continue
+		}
+		// Stopping a process that isn't running still resets its restart
+		// counter.
+		process.Stop()
+		if info.Running {
+			stopped++
+		}
+	}
+
+	return stopped
 }
 
 // Cleanup implements caddy.CleanerUpper.
 func (o *OndemandUpstreams) Cleanup() error {
-	if o.upstreamProcess != nil && o.upstreamProcess.IsRunning() {
-		o.upstreamProcess.Stop()
+	unregisterUpstream(o)
+
+	o.mu.Lock()
+	var processes []*UpstreamProcess
+	for _, t := range o.tenants {
+		processes = append(processes, t.processes...)
+	}
+	o.mu.Unlock()
+
+	for _, process := range processes {
+		// The restart counter is left alone so that, if it's being persisted,
+		// the next config's process picks up where this one left off.
+		process.stop(false)
+		process.RemoveSocket()
 	}
 
 	return nil
@@ -0,0 +1,478 @@
+package caddy_ondemand_upstreams
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConcurrentColdStartStartsOneProcess(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:      "concurrent-cold-start",
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 50)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, cancel := newTestRequest("example.com")
+			defer cancel()
+			if _, err := o.GetUpstreams(r); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if starts := testutil.ToFloat64(processStarts.WithLabelValues(o.Name)); starts != 1 {
+		t.Fatalf("expected 1 process to be started, got %v", starts)
+	}
+}
+
+// running returns the number of processes that are running.
+func running(processes []*UpstreamProcess) int {
+	n := 0
+	for _, process := range processes {
+		if process.IsRunning() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestLongRequestDoesNotKeepOtherReplicasRunning(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:     helperCommand("serve", "%d"),
+		Readiness:   &Readiness{Mode: "tcp"},
+		Replicas:    2,
+		IdleTimeout: caddy.Duration(time.Second),
+	})
+
+	// Two concurrent requests need two replicas.
+	var cancels []func()
+	for i := 0; i < 2; i++ {
+		r, cancel := newTestRequest("example.com")
+		cancels = append(cancels, cancel)
+		upstreams, err := o.GetUpstreams(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selectUpstream(r, upstreams[0])
+	}
+	waitFor(t, 5*time.Second, "both replicas to start", func() bool { return running(testProcesses(o)) == 2 })
+
+	// A long-running request arrives while both replicas are running, and the
+	// load balancing policy picks the second one. Then the others finish.
+	long, cancelLong := newTestRequest("example.com")
+	defer cancelLong()
+	upstreams, err := o.GetUpstreams(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 2 {
+		t.Fatalf("expected both replicas to be offered to the load balancer, got %d", len(upstreams))
+	}
+	processes := testProcesses(o)
+	if dial := selectUpstream(long, upstreams[1]); dial != processes[1].GetDial() {
+		t.Fatalf("expected the selected upstream to dial the second replica at %s, got %s", processes[1].GetDial(), dial)
+	}
+	for _, cancel := range cancels {
+		cancel()
+	}
+
+	// Only the replica serving the long request is busy, so the other one
+	// reaches its idle timeout.
+	waitFor(t, 5*time.Second, "the idle replica to stop", func() bool { return !processes[0].IsRunning() })
+	if !processes[1].IsRunning() || processes[1].inFlight.Load() != 1 {
+		t.Fatalf("expected the replica serving the long request to keep running, got %+v", processes[1].Info())
+	}
+}
+
+func TestOtherTenantUsersDontCountAsDemand(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+		Replicas:  2,
+	})
+
+	// Dependants and background starts hold the tenant without being requests.
+	for i := 0; i < 3; i++ {
+		command, _ := o.command(nil)
+		tn, err := o.acquire(command)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer o.release(tn)
+	}
+
+	r, cancel := newTestRequest("example.com")
+	defer cancel()
+	if _, err := o.GetUpstreams(r); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(testProcesses(o)); n != 1 {
+		t.Fatalf("expected 1 replica for 1 request, got %d", n)
+	}
+}
+
+func TestUnsafeRequestPlaceholderIsRejected(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   helperCommand("serve", "%d", "{http.request.host}"),
+		Dir:       dir,
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+
+	for _, host := range []string{"x;touch pwned", "$(touch pwned)", "x%d"} {
+		r, cancel := newTestRequest(host)
+		_, err := o.GetUpstreams(r)
+		cancel()
+		if err == nil {
+			t.Fatalf("expected the request for %q to fail", host)
+		}
+	}
+	if n := len(testProcesses(o)); n != 0 {
+		t.Fatalf("expected no processes to be created, got %d", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("expected the injected command not to run, got %v", err)
+	}
+
+	r, cancel := newTestRequest("tenant-1.example.com")
+	defer cancel()
+	if _, err := o.GetUpstreams(r); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepWarmHostSurvivesIdleTimeout(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:     helperCommand("serve", "%d", "{http.request.host}"),
+		Readiness:   &Readiness{Mode: "tcp"},
+		IdleTimeout: caddy.Duration(time.Second),
+		KeepWarm:    []string{"warm.example.com"},
+	})
+
+	tenantProcess := func(host string) *UpstreamProcess {
+		r, cancel := newTestRequest(host)
+		defer cancel()
+		if _, err := o.GetUpstreams(r); err != nil {
+			t.Fatal(err)
+		}
+		command, err := o.command(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		return o.tenants[command].processes[0]
+	}
+	warm := tenantProcess("warm.example.com:443")
+	cold := tenantProcess("cold.example.com")
+
+	waitFor(t, 5*time.Second, "the other host's process to stop", func() bool { return !cold.IsRunning() })
+	if !warm.IsRunning() {
+		t.Fatal("expected the keep-warm host's process to still be running")
+	}
+}
+
+// parseCaddyfile unmarshals an ondemand block from input.
+func parseCaddyfile(input string) (*OndemandUpstreams, error) {
+	o := new(OndemandUpstreams)
+	err := o.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+	return o, err
+}
+
+func TestStartupTimeoutIsAliasForMaxStartingTime(t *testing.T) {
+	o, err := parseCaddyfile(`ondemand {
+		command "./app --port %d"
+		startup_timeout 10s
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.MaxStartingTime != caddy.Duration(10*time.Second) {
+		t.Fatalf("expected max_starting_time to be 10s, got %v", time.Duration(o.MaxStartingTime))
+	}
+
+	_, err = parseCaddyfile(`ondemand {
+		command "./app --port %d"
+		max_starting_time 10s
+		startup_timeout 20s
+	}`)
+	if err == nil {
+		t.Fatal("expected an error for setting both max_starting_time and startup_timeout")
+	}
+}
+
+func TestIgnoredRequestsDontResetIdleTimer(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:              helperCommand("serve", "%d"),
+		Readiness:            &Readiness{Mode: "tcp"},
+		IgnoreActivityHeader: "X-Health-Check",
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+
+	request := func(header bool) {
+		r, cancel := newTestRequest("example.com")
+		if header {
+			r.Header.Set("X-Health-Check", "1")
+		}
+		upstreams, err := o.GetUpstreams(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selectUpstream(r, upstreams[0])
+		cancel()
+		waitFor(t, 5*time.Second, "the request to finish", func() bool { return process.inFlight.Load() == 0 })
+	}
+
+	waitFor(t, 5*time.Second, "the first request to finish", func() bool { return process.inFlight.Load() == 0 })
+	idle := time.Now().Add(-time.Minute)
+	process.lastActivity.Store(idle.UnixNano())
+	request(true)
+	time.Sleep(50 * time.Millisecond)
+	if !process.lastActive().Equal(idle) {
+		t.Fatalf("expected a request with the header not to count as activity, last activity is %v", process.lastActive())
+	}
+
+	request(false)
+	waitFor(t, 5*time.Second, "the request to count as activity", func() bool { return process.lastActive().After(idle) })
+}
+
+func TestBlockUntilWarm(t *testing.T) {
+	newUpstream := func(block bool) *OndemandUpstreams {
+		return newTestUpstream(t, &OndemandUpstreams{
+			Command:        helperCommand("serve", "%d"),
+			Readiness:      &Readiness{Mode: "tcp"},
+			StartupDelay:   caddy.Duration(500 * time.Millisecond),
+			BlockUntilWarm: block,
+		})
+	}
+
+	t.Run("on", func(t *testing.T) {
+		o := newUpstream(true)
+		for i := 0; i < 2; i++ {
+			var herr caddyhttp.HandlerError
+			if err := get(o); !errors.As(err, &herr) || herr.StatusCode != http.StatusServiceUnavailable || !strings.Contains(err.Error(), "warming up") {
+				t.Fatalf("request %d: expected the request to be turned away with a 503, got %v", i, err)
+			}
+		}
+		waitFor(t, 10*time.Second, "the upstream to warm up", func() bool { return get(o) == nil })
+	})
+
+	t.Run("off", func(t *testing.T) {
+		o := newUpstream(false)
+		if err := get(o); err != nil {
+			t.Fatalf("expected the request to wait for the process, got %v", err)
+		}
+	})
+}
+
+func TestIdleTimeout(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		config string
+		want   time.Duration
+	}{
+		{"unset", "", 300 * time.Second},
+		{"explicit", "idle_timeout 30s", 30 * time.Second},
+		{"off", "idle_timeout off", -1},
+		{"negative", "idle_timeout -1", -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o, err := parseCaddyfile("ondemand {\ncommand \"./app --port %d\"\n" + tc.config + "\n}")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := o.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			if got := time.Duration(o.IdleTimeout); got != tc.want {
+				t.Fatalf("expected idle_timeout %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIdleTimeoutOffKeepsProcessRunning(t *testing.T) {
+	o, err := parseCaddyfile("ondemand {\ncommand ./app\nidle_timeout off\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.Command = helperCommand("serve", "%d")
+	o.Readiness = &Readiness{Mode: "tcp"}
+	newTestUpstream(t, o)
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	waitFor(t, time.Second, "the request to finish", func() bool { return process.inFlight.Load() == 0 })
+	process.lastActivity.Store(time.Now().Add(-time.Hour).UnixNano())
+
+	// The idle timeout is checked every second.
+	time.Sleep(2500 * time.Millisecond)
+	if !process.IsRunning() {
+		t.Fatal("expected the process to keep running with idle_timeout off")
+	}
+}
+
+func TestReplicaStartsPastScaleThreshold(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:        helperCommand("serve", "%d"),
+		Readiness:      &Readiness{Mode: "tcp"},
+		Replicas:       3,
+		ScaleThreshold: 2,
+	})
+
+	// Requests stay in flight until they're canceled.
+	hold := func() {
+		r, cancel := newTestRequest("example.com")
+		t.Cleanup(cancel)
+		if _, err := o.GetUpstreams(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	hold()
+	hold()
+	if n := len(testProcesses(o)); n != 1 {
+		t.Fatalf("expected 1 replica at the threshold, got %d", n)
+	}
+
+	hold()
+	waitFor(t, 10*time.Second, "a second replica to start", func() bool { return running(testProcesses(o)) == 2 })
+	if n := len(testProcesses(o)); n != 2 {
+		t.Fatalf("expected 2 replicas past the threshold, got %d", n)
+	}
+}
+
+func TestStartingReplicaDoesNotHoldUpRequests(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:      helperCommand("serve", "%d"),
+		Replicas:     2,
+		StartupDelay: caddy.Duration(2 * time.Second),
+	})
+
+	hold := func() time.Duration {
+		r, cancel := newTestRequest("example.com")
+		t.Cleanup(cancel)
+		begin := time.Now()
+		if _, err := o.GetUpstreams(r); err != nil {
+			t.Fatal(err)
+		}
+		return time.Since(begin)
+	}
+
+	// The first request waits for the first replica, and the second one
+	// starts the other replica in the background.
+	hold()
+	hold()
+	waitFor(t, time.Second, "the second replica to start starting", func() bool {
+		processes := testProcesses(o)
+		return len(processes) == 2 && processes[1].IsStarting()
+	})
+
+	// The first replica can serve requests while the second one is starting.
+	if took := hold(); took > time.Second {
+		t.Fatalf("expected the request not to wait for the starting replica, took %s", took)
+	}
+}
+
+func TestRetriedRequestIsCountedOnce(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+
+	r, cancel := newTestRequest("example.com")
+	defer cancel()
+
+	// The reverse proxy gets the upstreams again each time it retries.
+	for i := 0; i < 3; i++ {
+		upstreams, err := o.GetUpstreams(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selectUpstream(r, upstreams[0])
+	}
+
+	process := testProcesses(o)[0]
+	if n := process.inFlight.Load(); n != 1 {
+		t.Fatalf("expected 1 request in flight, got %d", n)
+	}
+	command, _ := o.command(nil)
+	o.mu.Lock()
+	tn := o.tenants[command]
+	o.mu.Unlock()
+	if n := tn.requests.Load(); n != 1 {
+		t.Fatalf("expected 1 request for the tenant, got %d", n)
+	}
+
+	cancel()
+	waitFor(t, 5*time.Second, "the request to finish", func() bool { return process.inFlight.Load() == 0 })
+}
+
+func TestDependencyIsStartedFirst(t *testing.T) {
+	a := newTestUpstream(t, &OndemandUpstreams{
+		Name:      "dependency-a",
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+	b := newTestUpstream(t, &OndemandUpstreams{
+		Name:      "dependency-b",
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+		DependsOn: []string{"dependency-a"},
+	})
+
+	if err := get(b); err != nil {
+		t.Fatal(err)
+	}
+	if n := running(testProcesses(a)); n != 1 {
+		t.Fatalf("expected the dependency to be running, got %d processes", n)
+	}
+}
+
+func TestDependencyCycleIsRejected(t *testing.T) {
+	a := newTestUpstream(t, &OndemandUpstreams{
+		Name:      "cycle-a",
+		Command:   helperCommand("serve", "%d"),
+		DependsOn: []string{"cycle-b"},
+	})
+	b := newTestUpstream(t, &OndemandUpstreams{
+		Name:      "cycle-b",
+		Command:   helperCommand("serve", "%d"),
+		DependsOn: []string{"cycle-a"},
+	})
+
+	err := get(a)
+	if err == nil || !strings.Contains(err.Error(), "dependency cycle: cycle-a -> cycle-b -> cycle-a") {
+		t.Fatalf("expected a dependency cycle error, got %v", err)
+	}
+	if n := len(testProcesses(a)) + len(testProcesses(b)); n != 0 {
+		t.Fatalf("expected no processes to be created, got %d", n)
+	}
+}
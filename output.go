@@ -0,0 +1,147 @@
+package caddy_ondemand_upstreams
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// captureOutput returns the write end of a pipe whose contents are read line by
+// line. Each line is added to the process's output buffer, if it has one, and
+// then written to dest, or logged to Caddy's log if dest is nil. If closeDest
+// is true, dest is closed once all output has been read. The caller must close
+// the returned file once the process has exited so that the reader sees EOF
+// and stops.
+func (u *UpstreamProcess) captureOutput(stream string, dest *os.File, closeDest bool) (*os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, fmt.Errorf("creating output pipe: %v", err)
+	}
+
+	logger := u.logger.With(zap.String("upstream", u.name), zap.String("stream", stream))
+	go func() {
+		defer r.Close()
+		if closeDest {
+			defer dest.Close()
+		}
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if u.outputBuffer != nil {
+				u.outputBuffer.Add(stream, line)
+			}
+			if dest == nil {
+				logLine(logger, u.logFormat, line)
+			} else {
+				fmt.Fprintln(dest, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			logger.Info("error while reading upstream output: " + fmt.Sprint(err))
+
+			// Keep reading so that the process doesn't block on a full pipe.
+			if dest == nil {
+				io.Copy(io.Discard, r)
+			} else {
+				io.Copy(dest, r)
+			}
+		}
+	}()
+
+	return w, nil
+}
+
+// entryKeys are the fields that every entry of captured output has. A JSON
+// line's keys with the same names are logged with an "output." prefix instead,
+// so that they can't overwrite them.
+var entryKeys = map[string]bool{"upstream": true, "stream": true}
+
+// logLine logs a single line of process output. In "json" format, a line that
+// is a JSON object has its keys logged as fields of the entry; anything else is
+// logged as text in the output field.
+func logLine(logger *zap.Logger, format string, line string) {
+	if format == "json" {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err == nil {
+			keys := make([]string, 0, len(entry))
+			for k := range entry {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+
+			fields := make([]zap.Field, 0, len(keys))
+			for _, k := range keys {
+				name := k
+				if entryKeys[k] {
+					name = "output." + k
+				}
+				fields = append(fields, zap.Any(name, entry[k]))
+			}
+			logger.Info("upstream output", fields...)
+			return
+		}
+	}
+
+	logger.Info("upstream output", zap.String("output", line))
+}
+
+// outputLine is a single line of process output kept in an outputBuffer.
+type outputLine struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Line   string    `json:"line"`
+}
+
+// outputBuffer is a ring buffer of the most recent lines of output from an
+// upstream's processes, so that they can be read through the admin API.
+type outputBuffer struct {
+	lines []outputLine
+	next  int
+	full  bool
+	mu    sync.Mutex
+}
+
+// newOutputBuffer returns an outputBuffer that holds up to size lines.
+func newOutputBuffer(size int) *outputBuffer {
+	return &outputBuffer{lines: make([]outputLine, size)}
+}
+
+// Add adds a line to the buffer, replacing the oldest line if it's full.
+func (b *outputBuffer) Add(stream string, line string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lines[b.next] = outputLine{Time: time.Now(), Stream: stream, Line: line}
+	b.next = (b.next + 1) % len(b.lines)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// Last returns up to n of the most recent lines, oldest first.
+func (b *outputBuffer) Last(n int) []outputLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	count := b.next
+	if b.full {
+		count = len(b.lines)
+	}
+	if n > count {
+		n = count
+	}
+
+	lines := make([]outputLine, n)
+	for i := range lines {
+		lines[i] = b.lines[(b.next-n+i+len(b.lines))%len(b.lines)]
+	}
+	return lines
+}
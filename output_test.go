@@ -0,0 +1,67 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestJSONOutputCantOverwriteEntryFields(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	logger := zap.New(core).With(zap.String("upstream", "app"), zap.String("stream", "stdout"))
+
+	logLine(logger, "json", `{"upstream":"other","stream":"stderr","level":"warn"}`)
+
+	entries := logs.All()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(entries))
+	}
+	fields := entries[0].ContextMap()
+	if fields["upstream"] != "app" || fields["stream"] != "stdout" {
+		t.Fatalf("expected the entry's own fields to be kept, got %v", fields)
+	}
+	if fields["output.upstream"] != "other" || fields["output.stream"] != "stderr" || fields["level"] != "warn" {
+		t.Fatalf("expected the line's clashing keys to be prefixed and the rest kept, got %v", fields)
+	}
+}
+
+func TestJSONOutputIsLoggedWithFields(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:       "json-output",
+		Command:    `echo '{"msg":"hello","n":1}'; exec sleep 30`,
+		Port:       1,
+		StdoutFile: "log",
+		LogFormat:  "json",
+	})
+
+	core, logs := observer.New(zap.InfoLevel)
+	command, err := o.command(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tn, err := o.acquire(command)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o.replicas(tn, 1)[0].logger = zap.New(core)
+	o.release(tn)
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, 5*time.Second, "the output to be logged", func() bool {
+		return logs.FilterMessage("upstream output").Len() > 0
+	})
+	fields := logs.FilterMessage("upstream output").All()[0].ContextMap()
+	if fields["msg"] != "hello" || fields["n"] != float64(1) {
+		t.Fatalf("expected the line's fields to be logged, got %v", fields)
+	}
+	if fields["upstream"] != "json-output" || fields["stream"] != "stdout" {
+		t.Fatalf("expected the entry to identify the upstream and stream, got %v", fields)
+	}
+}
@@ -1,69 +1,423 @@
 package caddy_ondemand_upstreams
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
 )
 
+// exitCheckDelay is how long start() waits for a process that has no startup
+// delay or readiness probe to exit before reporting it as started.
+const exitCheckDelay = 100 * time.Millisecond
+
 type UpstreamProcess struct {
+	id                     int64
+	name                   string
+	logger                 *zap.Logger
 	cmd                    *exec.Cmd
+	exited                 chan struct{}
+	exitErr                error
 	command                string
+	shell                  []string
 	port                   int
+	socket                 string
+	socketPath             string
 	dir                    string
+	user                   string
+	namespaces             []string
 	env                    map[string]string
+	stdoutFile             string
+	stderrFile             string
+	logFormat              string
+	outputBuffer           *outputBuffer
 	startupDelay           time.Duration
+	readiness              *Readiness
+	smokeTest              *SmokeTest
+	maxStartingTime        time.Duration
 	idleTimeout            time.Duration
 	terminationGracePeriod time.Duration
-	lastActivity           time.Time
+	restartPolicy          string
+	maxRestarts            int
+	restartCooldown        time.Duration
+	restarts               int
+	gaveUpAt               time.Time
+	startedAt              time.Time
+	restartStateKey        string
+	restartTimer           *time.Timer
+	stops                  int
+	startFailures          int
+	startErr               error
+	retryAfter             time.Time
+	activityInterval       time.Duration
+	lastActivity           atomic.Int64
+	inFlight               atomic.Int64
 	mu                     sync.Mutex
+
+	// The in-flight startup, if any. Guarded by startMu rather than mu so that
+	// concurrent callers can find it while the startup itself holds mu.
+	starting *startup
+	startMu  sync.Mutex
+
+	// The running process, if any, for Info(). It's kept outside of mu
+	// because mu is held for as long as it takes to start or stop the
+	// process.
+	running atomic.Pointer[runningProcess]
+
+	// Whether the process has finished starting and can be sent requests.
+	// Like running, it's kept outside of mu so that requests can be routed
+	// to other replicas while this one is starting or stopping.
+	ready atomic.Bool
+
+	// Whether the process has been picked to be stopped for being idle.
+	// Guarded by idleMu so that requests can't start while the idle timeout
+	// is deciding to stop the process.
+	stopping bool
+	idleMu   sync.Mutex
+}
+
+// runningProcess describes a running process.
+type runningProcess struct {
+	pid  int
+	dial string
+}
+
+// startup tracks a single in-flight call to start() so that concurrent callers
+// can wait for it and share its result instead of launching their own process.
+type startup struct {
+	done chan struct{}
+	err  error
 }
 
-func NewUpstreamProcess(command string, port int, dir string, env map[string]string, startup_delay time.Duration, idle_timeout time.Duration, termination_grace_period time.Duration) *UpstreamProcess {
-	return &UpstreamProcess{
+func NewUpstreamProcess(name string, command string, shell []string, port int, socket string, dir string, user string, namespaces []string, env map[string]string, stdout_file string, stderr_file string, log_format string, output_buffer *outputBuffer, startup_delay time.Duration, readiness *Readiness, smoke_test *SmokeTest, max_starting_time time.Duration, idle_timeout time.Duration, termination_grace_period time.Duration, restart_policy string, max_restarts int, restart_cooldown time.Duration, activity_interval time.Duration) *UpstreamProcess {
+	u := &UpstreamProcess{
+		id:                     processCounter.Add(1),
+		name:                   name,
+		logger:                 caddy.Log().Named(CHANNEL),
 		command:                command,
+		shell:                  shell,
 		port:                   port,
+		socket:                 socket,
 		dir:                    dir,
+		user:                   user,
+		namespaces:             namespaces,
 		env:                    env,
+		stdoutFile:             stdout_file,
+		stderrFile:             stderr_file,
+		logFormat:              log_format,
+		outputBuffer:           output_buffer,
 		startupDelay:           startup_delay,
+		readiness:              readiness,
+		smokeTest:              smoke_test,
+		maxStartingTime:        max_starting_time,
 		idleTimeout:            idle_timeout,
 		terminationGracePeriod: termination_grace_period,
-		lastActivity:           time.Now(),
+		restartPolicy:          restart_policy,
+		maxRestarts:            max_restarts,
+		restartCooldown:        restart_cooldown,
+		activityInterval:       activity_interval,
 	}
+	u.lastActivity.Store(time.Now().UnixNano())
+
+	return u
 }
 
 func (u *UpstreamProcess) GetPort() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
 	return u.port
 }
 
+// GetDial returns the address that the reverse proxy should dial to reach the
+// process: either localhost:<port>, or unix/<path> when using a unix socket.
+func (u *UpstreamProcess) GetDial() string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.dial()
+}
+
+// dial is GetDial for callers that already hold u.mu.
+func (u *UpstreamProcess) dial() string {
+	network, addr := u.address()
+	if network == "unix" {
+		return "unix/" + addr
+	}
+	return addr
+}
+
+// address returns the network and address the process listens on.
+func (u *UpstreamProcess) address() (string, string) {
+	if u.socket != "" {
+		return "unix", u.socketPath
+	}
+	return "tcp", net.JoinHostPort("localhost", strconv.Itoa(u.port))
+}
+
 func (u *UpstreamProcess) IsRunning() bool {
-	// TODO: This is not working as expected.
-	// return u.cmd != nil && !u.cmd.ProcessState.Exited()
-	return u.cmd != nil
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.isRunning()
+}
+
+// isRunning is IsRunning for callers that already hold u.mu.
+func (u *UpstreamProcess) isRunning() bool {
+	if u.cmd == nil || u.exited == nil {
+		return false
+	}
+
+	select {
+	case <-u.exited:
+		return false
+	default:
+		return true
+	}
+}
+
+// PersistRestarts makes the process save its restart counter under key, and
+// picks up where a previous process saved under the same key left off. This
+// lets crash-loop protection survive config reloads.
+func (u *UpstreamProcess) PersistRestarts(key string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.restartStateKey = key
+	s := loadRestartState(key)
+	u.restarts = s.restarts
+	u.gaveUpAt = s.gaveUpAt
+}
+
+// saveRestarts saves the restart counter if it's being persisted. The caller
+// must hold u.mu.
+func (u *UpstreamProcess) saveRestarts() {
+	if u.restartStateKey == "" {
+		return
+	}
+	saveRestartState(u.restartStateKey, restartState{restarts: u.restarts, gaveUpAt: u.gaveUpAt})
+}
+
+// ResetRestarts ends the current run of unexpected exits, so that a process
+// that was given up on can be started again straight away.
+func (u *UpstreamProcess) ResetRestarts() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.resetRestarts()
+}
+
+// resetRestarts is ResetRestarts for callers that already hold u.mu.
+func (u *UpstreamProcess) resetRestarts() {
+	u.restarts = 0
+	u.gaveUpAt = time.Time{}
+	u.saveRestarts()
+}
+
+// processInfo describes an upstream process for the admin API.
+type processInfo struct {
+	Upstream     string    `json:"upstream"`
+	Command      string    `json:"command"`
+	Dial         string    `json:"dial"`
+	PID          int       `json:"pid,omitempty"`
+	Running      bool      `json:"running"`
+	InFlight     int64     `json:"in_flight"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// Info returns a description of the process. It doesn't wait for the process
+// to finish starting or stopping.
+func (u *UpstreamProcess) Info() processInfo {
+	info := processInfo{
+		Upstream:     u.name,
+		Command:      u.command,
+		InFlight:     u.inFlight.Load(),
+		LastActivity: u.lastActive(),
+	}
+	if running := u.running.Load(); running != nil {
+		info.Running = true
+		info.PID = running.pid
+		info.Dial = running.dial
+	}
+	return info
+}
+
+// dialKey returns the placeholder key that the reverse proxy resolves to the
+// process's address, which tells replicas apart until one has been picked.
+func (u *UpstreamProcess) dialKey() string {
+	return "ondemand.replica." + strconv.FormatInt(u.id, 10)
+}
+
+// IsReady reports whether the process has finished starting and can be sent
+// requests. Unlike IsRunning, it doesn't wait for the process to finish
+// starting or stopping.
+func (u *UpstreamProcess) IsReady() bool {
+	return u.ready.Load()
+}
+
+// IsStarting reports whether a call to Start is in progress.
+func (u *UpstreamProcess) IsStarting() bool {
+	u.startMu.Lock()
+	defer u.startMu.Unlock()
+
+	return u.starting != nil
+}
+
+// IsIdle reports whether the process is stopped and will stay that way until
+// Start is called: it isn't running, starting up, or waiting to be restarted.
+func (u *UpstreamProcess) IsIdle() bool {
+	if u.IsStarting() {
+		return false
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return !u.isRunning() && u.restartTimer == nil
 }
 
+// LogActivity records that the process has received traffic, which resets its
+// idle timeout. If an activity interval is set, activity is only recorded once
+// per interval, which is plenty for idle timeout purposes and avoids
+// contention between concurrent requests.
 func (u *UpstreamProcess) LogActivity() {
-	u.lastActivity = time.Now()
+	now := time.Now().UnixNano()
+	if u.activityInterval > 0 && now-u.lastActivity.Load() < int64(u.activityInterval) {
+		return
+	}
+	u.lastActivity.Store(now)
+}
+
+// RequestStarted records that a request that may be proxied to the process is
+// in flight. The process won't be stopped for being idle until every such
+// request has finished. It returns false, without recording the request, if
+// the process is already being stopped for being idle; the request should go
+// elsewhere.
+func (u *UpstreamProcess) RequestStarted() bool {
+	u.idleMu.Lock()
+	defer u.idleMu.Unlock()
+
+	if u.stopping {
+		return false
+	}
+	u.inFlight.Add(1)
+	return true
+}
+
+// RequestFinished records that a request started with RequestStarted is done.
+// If the request counted as activity, the idle timeout is measured from when
+// it finished rather than when it started, so that a long-running request
+// doesn't leave the process to be stopped as soon as it's done. Like any other
+// activity, it's throttled by the activity interval.
+func (u *UpstreamProcess) RequestFinished(activity bool) {
+	// The activity is recorded first so that the idle timeout can't see the
+	// request as finished without it.
+	if activity {
+		u.LogActivity()
+	}
+	u.inFlight.Add(-1)
+}
+
+// stopIfIdle stops the process if no requests are in flight and its idle
+// timeout has passed, and reports whether it did. Once it has decided to stop
+// the process, RequestStarted turns requests away, so that none are sent to a
+// process that's on its way out.
+func (u *UpstreamProcess) stopIfIdle() bool {
+	u.idleMu.Lock()
+	if u.inFlight.Load() > 0 || u.lastActive().Add(u.idleTimeout).After(time.Now()) {
+		u.idleMu.Unlock()
+		return false
+	}
+	u.stopping = true
+	u.ready.Store(false)
+	u.idleMu.Unlock()
+
+	caddy.Log().Named(CHANNEL).Info("idle timeout reached; stopping upstream process at " + u.GetDial())
+	idleShutdowns.WithLabelValues(u.name).Inc()
+	u.Stop()
+	return true
+}
+
+// lastActive returns the time that activity was last recorded.
+func (u *UpstreamProcess) lastActive() time.Time {
+	return time.Unix(0, u.lastActivity.Load())
 }
 
+// Start starts the upstream process if it isn't already running. If another
+// caller is already starting the process, Start waits for that startup to
+// finish and returns its result rather than starting a second process.
 func (u *UpstreamProcess) Start() error {
+	u.startMu.Lock()
+	if s := u.starting; s != nil {
+		u.startMu.Unlock()
+		<-s.done
+		return s.err
+	}
+	s := &startup{done: make(chan struct{})}
+	u.starting = s
+	u.startMu.Unlock()
+
+	s.err = u.start()
+
+	u.startMu.Lock()
+	u.starting = nil
+	u.startMu.Unlock()
+	close(s.done)
+
+	return s.err
+}
+
+func (u *UpstreamProcess) start() (err error) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
 	// If it's already running, nothing needs to happen.
-	if u.IsRunning() {
+	if u.isRunning() {
 		caddy.Log().Named(CHANNEL).Info("upstream process is already running")
 		return nil
 	}
 
-	// Assign a port if needed.
-	if u.port == -1 {
+	// If the process keeps crashing, don't keep trying to start it until the
+	// cooldown has passed.
+	if !u.gaveUpAt.IsZero() {
+		if wait := time.Until(u.gaveUpAt.Add(u.restartCooldown)); wait > 0 {
+			return fmt.Errorf("no upstreams available: upstream process kept exiting after %d restarts; retrying in %s", u.restarts, wait.Round(time.Second))
+		}
+		u.resetRestarts()
+	}
+
+	// If the process failed to start recently, don't try again until the
+	// backoff has passed, so that a broken command isn't run for every
+	// request.
+	if wait := time.Until(u.retryAfter); wait > 0 {
+		return fmt.Errorf("upstream process failed to start recently; retrying in %s: %v", wait.Round(time.Millisecond), u.startErr)
+	}
+	defer func() {
+		u.recordStart(err)
+	}()
+
+	begin := time.Now()
+
+	// Assign a socket path or port if needed.
+	if u.socket != "" {
+		if u.socketPath == "" {
+			u.socketPath = getSocketPath(u.socket)
+		}
+		// Remove any stale socket so the process can bind to it.
+		u.removeSocket()
+	} else if u.port == -1 {
 		port, err := getAvailablePort()
 		if err != nil {
 			return err
@@ -72,97 +426,535 @@ func (u *UpstreamProcess) Start() error {
 	}
 
 	// Create the exec command.
-	c := u.getFormattedCommand()
-	u.cmd = exec.Command("sh", "-c", c)
-	u.cmd.Stdout = os.Stdout
-	u.cmd.Stderr = os.Stderr
+	cmd, err := u.buildCommand(u.getFormattedCommand())
+	if err != nil {
+		return err
+	}
+	u.cmd = cmd
 	u.cmd.Dir = u.dir
 	for k, v := range u.env {
 		u.cmd.Env = append(u.cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
+	if u.user != "" {
+		if err := setUser(u.cmd, u.user); err != nil {
+			u.cmd = nil
+			return err
+		}
+	}
+	if len(u.namespaces) > 0 {
+		if err := setNamespaces(u.cmd, u.namespaces); err != nil {
+			u.cmd = nil
+			return err
+		}
+	}
+
+	if u.readiness != nil {
+		u.readiness.Reset(u.readyFile())
+	}
+
+	// Set up output redirection. Any files opened here are closed once the
+	// process exits.
+	var files []*os.File
+	stdout, opened, err := u.openOutput(u.stdoutFile, "stdout", os.Stdout)
+	if err != nil {
+		u.cmd = nil
+		return err
+	}
+	if opened {
+		files = append(files, stdout)
+	}
+	stderr, opened, err := u.openOutput(u.stderrFile, "stderr", os.Stderr)
+	if err != nil {
+		closeFiles(files)
+		u.cmd = nil
+		return err
+	}
+	if opened {
+		files = append(files, stderr)
+	}
+	u.cmd.Stdout = stdout
+	u.cmd.Stderr = stderr
 
 	caddy.Log().Named(CHANNEL).Info("starting upstream process")
-	err := u.cmd.Start()
+	err = u.cmd.Start()
 	if err != nil {
 		caddy.Log().Named(CHANNEL).Info("error while starting upstream process: " + fmt.Sprint(err))
+		closeFiles(files)
+		u.cmd = nil
 		return err
 	}
 	caddy.Log().Named(CHANNEL).Info("started upstream process")
+	processStarts.WithLabelValues(u.name).Inc()
+	runningProcesses.WithLabelValues(u.name).Inc()
+	registerProcess(u)
+	u.running.Store(&runningProcess{pid: u.cmd.Process.Pid, dial: u.dial()})
+	u.startedAt = time.Now()
+
+	// Watch for the process exiting, whether that's on its own or because
+	// Stop() was called.
+	exited := make(chan struct{})
+	u.exited = exited
+	go u.wait(u.cmd, exited, files)
+
+	// No matter how the startup delay and readiness probe are configured, the
+	// process may only spend maxStartingTime starting up.
+	ctx, cancel := context.WithTimeout(context.Background(), u.maxStartingTime)
+	defer cancel()
 
 	// Wait for the startup delay if needed.
 	if u.startupDelay > 0 {
 		caddy.Log().Named(CHANNEL).Info("waiting for upstream process to start")
-		time.Sleep(u.startupDelay)
+		select {
+		case <-time.After(u.startupDelay):
+		case <-exited:
+		case <-ctx.Done():
+		}
 		caddy.Log().Named(CHANNEL).Info("startup delay complete; continuing")
+	} else if u.readiness == nil {
+		// With nothing else to wait for, give the process a moment to fail so
+		// that one that exits straight away (for example, because of a bad
+		// command line) isn't reported as started.
+		select {
+		case <-time.After(exitCheckDelay):
+		case <-exited:
+		}
+	}
+
+	// If the process has already exited, there's nothing to proxy to.
+	if !u.isRunning() {
+		u.cmd = nil
+		return fmt.Errorf("upstream process exited during startup: %v", u.exitErr)
 	}
 
+	// Wait for the process to report that it's ready if needed.
+	err = ctx.Err()
+	if u.readiness != nil && err == nil {
+		caddy.Log().Named(CHANNEL).Info("waiting for upstream process to become ready")
+		network, addr := u.address()
+		err = u.readiness.Wait(ctx, network, addr, u.readyFile(), exited)
+		if err != nil && ctx.Err() == nil {
+			caddy.Log().Named(CHANNEL).Info("upstream process did not become ready: " + fmt.Sprint(err))
+			u.abortStart()
+			return err
+		}
+		if err == nil {
+			caddy.Log().Named(CHANNEL).Info("upstream process is ready")
+		}
+	}
+
+	// Make sure that the upstream responds the way we expect before sending
+	// any requests to it.
+	if u.smokeTest != nil && err == nil {
+		caddy.Log().Named(CHANNEL).Info("running smoke test against upstream process")
+		network, addr := u.address()
+		err = u.smokeTest.Run(ctx, network, addr)
+		if err != nil && ctx.Err() == nil {
+			caddy.Log().Named(CHANNEL).Info("upstream process failed smoke test: " + fmt.Sprint(err))
+			u.abortStart()
+			return err
+		}
+		if err == nil {
+			caddy.Log().Named(CHANNEL).Info("upstream process passed smoke test")
+		}
+	}
+
+	if err != nil {
+		caddy.Log().Named(CHANNEL).Info("upstream process exceeded max_starting_time; killing it")
+		u.abortStart()
+		return fmt.Errorf("upstream process was still starting after %s", u.maxStartingTime)
+	}
+
+	coldStartDuration.WithLabelValues(u.name).Observe(time.Since(begin).Seconds())
+
 	// Log activity to reset the counter for idle timeout.
 	u.LogActivity()
+	u.idleMu.Lock()
+	u.stopping = false
+	u.idleMu.Unlock()
+	u.ready.Store(true)
 
-	// Watch for idle timeout.
+	// Watch for idle timeout, unless it's disabled.
+	if u.idleTimeout < 0 {
+		return nil
+	}
 	go func() {
 		for {
-			time.Sleep(time.Second)
-			caddy.Log().Named(CHANNEL).Info("tick for service on port " + fmt.Sprint(u.GetPort()))
-
-			if u.lastActivity.Add(u.idleTimeout).After(time.Now()) {
-				continue
+			select {
+			case <-exited:
+				return
+			case <-time.After(time.Second):
 			}
+			caddy.Log().Named(CHANNEL).Info("tick for service at " + u.GetDial())
 
-			caddy.Log().Named(CHANNEL).Info("idle timeout reached; stopping upstream process on port " + fmt.Sprint(u.GetPort()))
-			u.Stop()
-			break
+			if u.stopIfIdle() {
+				return
+			}
 		}
 	}()
 
 	return nil
 }
 
+// recordStart updates the backoff for starting the process after an attempt to
+// start it. A single failure may be transient, such as a readiness probe that
+// timed out once, so the next attempt is allowed straight away. From the second
+// failure in a row, the next attempt is allowed after a second, doubling with
+// each further failure up to a minute. The caller must hold u.mu.
+func (u *UpstreamProcess) recordStart(err error) {
+	if err == nil {
+		u.startFailures = 0
+		u.startErr = nil
+		u.retryAfter = time.Time{}
+		return
+	}
+
+	u.startFailures++
+	u.startErr = err
+	if u.startFailures == 1 {
+		return
+	}
+
+	backoff := time.Minute
+	if n := u.startFailures - 2; n < 6 {
+		backoff = time.Second << n
+	}
+	u.retryAfter = time.Now().Add(backoff)
+}
+
+// abortStart kills a process that failed to start up properly and waits for it
+// to exit. The caller must hold u.mu.
+func (u *UpstreamProcess) abortStart() {
+	kill(u.cmd)
+	<-u.exited
+	u.cmd = nil
+	u.removeSocket()
+}
+
+// Stop stops the process, giving it until the termination grace period to exit
+// on its own. An intentional stop ends the current run of unexpected exits.
 func (u *UpstreamProcess) Stop() {
+	u.stop(true)
+}
+
+// stop stops the process and cancels any pending restart. If resetRestarts is
+// true, the stop also ends the current run of unexpected exits. Otherwise, any
+// persisted restart counter is left alone for the next process to pick up.
+func (u *UpstreamProcess) stop(resetRestarts bool) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
 
-	if !u.IsRunning() {
+	u.ready.Store(false)
+	u.stops++
+	if u.restartTimer != nil {
+		u.restartTimer.Stop()
+		u.restartTimer = nil
+	}
+	if resetRestarts {
+		u.resetRestarts()
+	}
+
+	if !u.isRunning() {
+		// Clearing cmd keeps handleExit() from restarting a process that
+		// exited just before it was going to be stopped anyway.
+		u.cmd = nil
 		return
 	}
 
-	caddy.Log().Named(CHANNEL).Info("sending SIGINT to gracefully stop the process")
-	err := u.cmd.Process.Signal(os.Interrupt)
-	if err == nil {
-		go func() {
-			// Wait for the termination grace period.
-			time.Sleep(u.terminationGracePeriod)
-			if u.IsRunning() {
-				caddy.Log().Named(CHANNEL).Info("grace period expired; sending SIGKILL to stop the process")
-				u.cmd.Process.Kill()
-			}
-		}()
-		u.cmd.Wait()
+	u.logger.Info("sending interrupt to gracefully stop the process")
+	interrupted := time.Now()
+	if err := interrupt(u.cmd); err != nil {
+		u.logger.Info("error while sending interrupt to process; sending SIGKILL instead: " + fmt.Sprint(err))
+		kill(u.cmd)
+	}
+
+	// Give the process until the end of the grace period to exit on its own.
+	// The exited channel is closed by the single cmd.Wait() call in wait().
+	timer := time.NewTimer(u.terminationGracePeriod)
+	defer timer.Stop()
+
+	select {
+	case <-u.exited:
+	case <-timer.C:
+		u.logger.Warn("upstream process ignored interrupt for the whole grace period; sending SIGKILL to stop the process",
+			zap.String("upstream", u.name),
+			zap.Int("pid", u.cmd.Process.Pid),
+			zap.String("command", u.command),
+			zap.Duration("ignored_for", time.Since(interrupted)),
+		)
+		forcedKills.WithLabelValues(u.name).Inc()
+		kill(u.cmd)
+		<-u.exited
+	}
+
+	u.logger.Info("upstream process stopped")
+
+	u.removeSocket()
+
+	u.cmd = nil
+}
+
+// wait blocks until the process exits, then closes the process's output files,
+// records the exit status, and closes the exited channel so that IsRunning()
+// reports the process as gone.
+func (u *UpstreamProcess) wait(cmd *exec.Cmd, exited chan struct{}, files []*os.File) {
+	err := cmd.Wait()
+	closeFiles(files)
+	runningProcesses.WithLabelValues(u.name).Dec()
+	// This happens before exited is closed, so that it can't race with a
+	// new process being registered by the next start().
+	u.running.Store(nil)
+	u.ready.Store(false)
+	unregisterProcess(u)
+	if err != nil {
+		caddy.Log().Named(CHANNEL).Info("upstream process exited: " + fmt.Sprint(err))
 	} else {
-		caddy.Log().Named(CHANNEL).Info("error while sending SIGINT to process: " + fmt.Sprint(err))
+		caddy.Log().Named(CHANNEL).Info("upstream process exited")
+	}
+
+	u.exitErr = err
+	close(exited)
+
+	u.handleExit(exited, err)
+}
+
+// handleExit applies the restart policy after the process exits. Processes
+// that exit because Stop() was called, or while they were still starting up,
+// will already have had u.cmd cleared and are left alone.
+func (u *UpstreamProcess) handleExit(exited chan struct{}, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.cmd == nil || u.exited != exited {
 		return
 	}
+	u.cmd = nil
+	crashes.WithLabelValues(u.name).Inc()
 
-	if u.IsRunning() {
-		caddy.Log().Named(CHANNEL).Info("grace period expired and process is still running; sending SIGKILL to stop the process")
-		u.cmd.Process.Kill()
+	switch u.restartPolicy {
+	case "always":
+	case "on_failure":
+		if err == nil {
+			return
+		}
+	default:
+		return
 	}
 
-	caddy.Log().Named(CHANNEL).Info("upstream process stopped")
+	// Only restart processes that are still within their idle window. Anything
+	// else can wait for the next request to start it again.
+	if u.idleTimeout >= 0 && u.lastActive().Add(u.idleTimeout).Before(time.Now()) {
+		return
+	}
 
-	u.cmd = nil
+	// A process that ran for long enough before exiting isn't crash looping,
+	// so this exit starts a new run.
+	if time.Since(u.startedAt) >= u.restartCooldown {
+		u.restarts = 0
+		u.saveRestarts()
+	}
+
+	u.scheduleRestart()
 }
 
-func (u *UpstreamProcess) getFormattedCommand() string {
-	command := u.command
-	if strings.Contains(command, "%d") {
-		command = fmt.Sprintf(command, u.port)
+// scheduleRestart starts the process again after an exponential backoff, unless
+// it has already been restarted maxRestarts times. The caller must hold u.mu.
+func (u *UpstreamProcess) scheduleRestart() {
+	if u.restarts >= u.maxRestarts {
+		caddy.Log().Named(CHANNEL).Info("upstream process exited unexpectedly too many times; not restarting")
+		u.gaveUpAt = time.Now()
+		u.saveRestarts()
+		return
+	}
+
+	backoff := time.Second << u.restarts
+	if backoff > time.Minute {
+		backoff = time.Minute
+	}
+	u.restarts++
+	u.saveRestarts()
+
+	caddy.Log().Named(CHANNEL).Info("restarting upstream process in " + fmt.Sprint(backoff))
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		u.mu.Lock()
+		if u.restartTimer != timer {
+			// Stop() was called while waiting.
+			u.mu.Unlock()
+			return
+		}
+		u.restartTimer = nil
+		stops := u.stops
+		u.mu.Unlock()
+
+		restarts.WithLabelValues(u.name).Inc()
+		if err := u.Start(); err != nil {
+			caddy.Log().Named(CHANNEL).Info("error while restarting upstream process: " + fmt.Sprint(err))
+			u.mu.Lock()
+			// Don't try again if Stop() was called during the attempt.
+			if u.stops == stops && !u.isRunning() {
+				u.scheduleRestart()
+			}
+			u.mu.Unlock()
+		}
+	})
+	u.restartTimer = timer
+}
+
+// RemoveSocket removes the process's unix socket file, if any. It is safe to
+// call when the process isn't using a socket.
+func (u *UpstreamProcess) RemoveSocket() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.isRunning() {
+		return
 	}
+	u.removeSocket()
+}
+
+// removeSocket is RemoveSocket for callers that already hold u.mu.
+func (u *UpstreamProcess) removeSocket() {
+	if u.socketPath == "" {
+		return
+	}
+	if err := os.Remove(u.socketPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		caddy.Log().Named(CHANNEL).Info("error while removing socket: " + fmt.Sprint(err))
+	}
+}
+
+func (u *UpstreamProcess) getFormattedCommand() string {
+	command := u.format(u.command)
 	caddy.Log().Named(CHANNEL).Info("formatted command for upstream: " + command)
 
 	return command
 }
 
+// format replaces the placeholder in template with the process's address: %s
+// with the socket path when using a socket, or %d with the port otherwise.
+func (u *UpstreamProcess) format(template string) string {
+	if u.socket != "" {
+		if strings.Contains(template, "%s") {
+			return fmt.Sprintf(template, u.socketPath)
+		}
+	} else if strings.Contains(template, "%d") {
+		return fmt.Sprintf(template, u.port)
+	}
+	return template
+}
+
+// readyFile returns the path of the process's readiness file, if it uses one.
+// The path gets the same placeholder as the command, so that each replica has
+// its own file, and is resolved against the process's directory if it's
+// relative. The caller must hold u.mu.
+func (u *UpstreamProcess) readyFile() string {
+	if u.readiness == nil || u.readiness.Mode != "file" {
+		return ""
+	}
+
+	path := u.format(u.readiness.File)
+	if !filepath.IsAbs(path) && u.dir != "" {
+		path = filepath.Join(u.dir, path)
+	}
+	return path
+}
+
+// buildCommand returns the exec command that runs the given command line. By
+// default the command line is run with the platform's shell. If the shell is
+// "none", the command line is split on whitespace and run directly.
+func (u *UpstreamProcess) buildCommand(command string) (*exec.Cmd, error) {
+	shell := u.shell
+	if len(shell) == 0 {
+		shell = defaultShell
+	}
+
+	var cmd *exec.Cmd
+	if len(shell) == 1 && shell[0] == "none" {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			return nil, fmt.Errorf("command is empty")
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	} else {
+		cmd = shellCommand(shell, command)
+	}
+	setProcessGroup(cmd)
+
+	return cmd, nil
+}
+
+// openOutput returns the file that one of the process's output streams should
+// be written to. An empty target uses def, "stdout" or "stderr" use Caddy's own
+// streams, and "log" sends each line to Caddy's log. Any other target is a file
+// to append to, resolved against the process's directory if it's relative. The
+// returned bool reports whether a file was opened that the caller is
+// responsible for closing.
+func (u *UpstreamProcess) openOutput(target string, stream string, def *os.File) (*os.File, bool, error) {
+	var dest *os.File
+	opened := false
+	switch target {
+	case "":
+		dest = def
+	case "stdout":
+		dest = os.Stdout
+	case "stderr":
+		dest = os.Stderr
+	case "log":
+	default:
+		path := target
+		if !filepath.IsAbs(path) && u.dir != "" {
+			path = filepath.Join(u.dir, path)
+		}
+
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, false, fmt.Errorf("opening output file: %v", err)
+		}
+		dest = f
+		opened = true
+	}
+
+	// Output only needs to be read line by line if it's being logged or kept
+	// in the output buffer. Otherwise the process can write to dest directly.
+	if dest != nil && u.outputBuffer == nil {
+		return dest, opened, nil
+	}
+
+	f, err := u.captureOutput(stream, dest, opened)
+	if err != nil {
+		if opened {
+			dest.Close()
+		}
+		return nil, false, err
+	}
+	return f, true, nil
+}
+
+// closeFiles closes each of the given files, logging any errors.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		if err := f.Close(); err != nil {
+			caddy.Log().Named(CHANNEL).Info("error while closing output file: " + fmt.Sprint(err))
+		}
+	}
+}
+
+// processCounter is used to give each UpstreamProcess a unique ID.
+var processCounter atomic.Int64
+
+// socketCounter is used to give each socket path generated by getSocketPath a
+// unique number.
+var socketCounter atomic.Int64
+
+// getSocketPath returns a socket path based on the given template. If the
+// template contains a %d placeholder, it is replaced with a number that is
+// unique within this Caddy process.
+func getSocketPath(template string) string {
+	if strings.Contains(template, "%d") {
+		return fmt.Sprintf(template, socketCounter.Add(1))
+	}
+	return template
+}
+
 // getAvailablePort returns an available port number.
 func getAvailablePort() (int, error) {
 	addr, err := net.ResolveTCPAddr("tcp", "localhost:0")
@@ -0,0 +1,49 @@
+package caddy_ondemand_upstreams
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// processGone reports whether the process with the given PID has exited. A
+// zombie counts as exited, since nothing may be left to reap it.
+func processGone(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return true
+	}
+	// The state follows the command name, which is in parentheses.
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func TestStartupTimeoutKillsProcessGroup(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestUpstream(t, &OndemandUpstreams{
+		// Nothing listens on the port, so the process never becomes ready.
+		Command:         "echo %d; sleep 30 & echo $! > child.pid; wait",
+		Dir:             dir,
+		Readiness:       &Readiness{Mode: "tcp"},
+		MaxStartingTime: caddy.Duration(500 * time.Millisecond),
+	})
+
+	if err := get(o); err == nil {
+		t.Fatal("expected the start to time out")
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, "child.pid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 5*time.Second, "the shell's child to be killed", func() bool { return processGone(pid) })
+}
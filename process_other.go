@@ -0,0 +1,30 @@
+//go:build !unix && !windows
+
+package caddy_ondemand_upstreams
+
+import (
+	"os"
+	"os/exec"
+)
+
+// defaultShell is the shell used to run commands when none is configured.
+var defaultShell = []string{"sh", "-c"}
+
+// shellCommand returns a command that runs the given command line with shell.
+func shellCommand(shell []string, command string) *exec.Cmd {
+	return exec.Command(shell[0], append(shell[1:], command)...)
+}
+
+// setProcessGroup prepares cmd so that interrupt and kill can reach it.
+// Nothing is needed on this platform.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// interrupt asks the process to exit gracefully by sending it os.Interrupt.
+func interrupt(cmd *exec.Cmd) error {
+	return cmd.Process.Signal(os.Interrupt)
+}
+
+// kill forcibly stops the process.
+func kill(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
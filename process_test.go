@@ -0,0 +1,370 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestStartFailsWhenProcessExitsImmediately(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{Command: "exit 3"})
+
+	for i := 0; i < 2; i++ {
+		r, cancel := newTestRequest("example.com")
+		_, err := o.GetUpstreams(r)
+		cancel()
+		if err == nil || !strings.Contains(err.Error(), "exit status 3") {
+			t.Fatalf("request %d: expected exit status 3, got %v", i, err)
+		}
+	}
+}
+
+func TestCrashedProcessIsStartedAgain(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   helperCommand("serve", "%d"),
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+
+	r, cancel := newTestRequest("example.com")
+	if _, err := o.GetUpstreams(r); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	process := testProcesses(o)[0]
+	pid := process.Info().PID
+	process.mu.Lock()
+	kill(process.cmd)
+	process.mu.Unlock()
+	waitFor(t, 5*time.Second, "the process to exit", func() bool { return !process.IsRunning() })
+
+	r, cancel = newTestRequest("example.com")
+	defer cancel()
+	upstreams, err := o.GetUpstreams(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(upstreams) != 1 {
+		t.Fatalf("expected 1 upstream, got %d", len(upstreams))
+	}
+	if newPID := process.Info().PID; newPID == pid || newPID == 0 {
+		t.Fatalf("expected a new process, got pid %d (was %d)", newPID, pid)
+	}
+}
+
+// gaveUp reports whether process has stopped restarting after too many
+// unexpected exits.
+func gaveUp(process *UpstreamProcess) bool {
+	process.mu.Lock()
+	defer process.mu.Unlock()
+
+	return !process.gaveUpAt.IsZero()
+}
+
+// crashLoop returns an upstream whose process exits shortly after every start
+// and is given up on after one restart.
+func crashLoop(t *testing.T, cooldown time.Duration) *OndemandUpstreams {
+	return newTestUpstream(t, &OndemandUpstreams{
+		Command:         "sleep 0.3; exit 1",
+		Port:            1,
+		RestartPolicy:   "always",
+		MaxRestarts:     1,
+		RestartCooldown: caddy.Duration(cooldown),
+	})
+}
+
+func TestGiveUpEndsAfterRestartCooldown(t *testing.T) {
+	o := crashLoop(t, time.Second)
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	waitFor(t, 10*time.Second, "the process to be given up on", func() bool { return gaveUp(process) })
+
+	if err := get(o); err == nil || !strings.Contains(err.Error(), "kept exiting") {
+		t.Fatalf("expected the request to fail while cooling down, got %v", err)
+	}
+
+	process.mu.Lock()
+	retry := process.gaveUpAt.Add(process.restartCooldown)
+	process.mu.Unlock()
+	time.Sleep(time.Until(retry))
+
+	if err := get(o); err != nil {
+		t.Fatalf("expected the process to be tried again after the cooldown, got %v", err)
+	}
+}
+
+func TestAdminStopAndStartResetGiveUp(t *testing.T) {
+	o := crashLoop(t, time.Hour)
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	waitFor(t, 10*time.Second, "the process to be given up on", func() bool { return gaveUp(process) })
+
+	if n := o.StopProcesses(0); n != 0 {
+		t.Fatalf("expected no running processes to be stopped, got %d", n)
+	}
+	if err := get(o); err != nil {
+		t.Fatalf("expected stopping to reset the restart counter, got %v", err)
+	}
+
+	waitFor(t, 10*time.Second, "the process to be given up on again", func() bool { return gaveUp(process) })
+	if err := o.Prewarm(); err != nil {
+		t.Fatalf("expected starting to reset the restart counter, got %v", err)
+	}
+}
+
+func TestStableRunResetsRestarts(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:            "stable-run",
+		Command:         "sleep 0.5; exit 1",
+		Port:            1,
+		RestartPolicy:   "always",
+		MaxRestarts:     1,
+		RestartCooldown: caddy.Duration(300 * time.Millisecond),
+	})
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	waitFor(t, 10*time.Second, "the process to be restarted twice", func() bool {
+		return testutil.ToFloat64(restarts.WithLabelValues(o.Name)) >= 2
+	})
+	if gaveUp(process) {
+		t.Fatal("expected exits after a stable run not to count towards max_restarts")
+	}
+}
+
+func TestStopDuringFailedRestartCancelsRestarts(t *testing.T) {
+	// The process runs once, and every restart fails during the startup
+	// delay.
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:          "stop-during-restart",
+		Command:       "if [ -e started ]; then sleep 0.5; exit 1; fi; touch started; sleep 1.5; exit 1",
+		Dir:           t.TempDir(),
+		Port:          1,
+		StartupDelay:  caddy.Duration(time.Second),
+		RestartPolicy: "always",
+		MaxRestarts:   5,
+	})
+
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+
+	// Holding startMu keeps the restart from starting until Stop() has been
+	// called.
+	process.startMu.Lock()
+	waitFor(t, 10*time.Second, "the process to be restarted", func() bool {
+		return testutil.ToFloat64(restarts.WithLabelValues(o.Name)) == 1
+	})
+	process.Stop()
+	process.startMu.Unlock()
+
+	waitFor(t, 5*time.Second, "the restart to fail", func() bool { return !process.IsStarting() })
+	time.Sleep(3 * time.Second)
+	if n := testutil.ToFloat64(restarts.WithLabelValues(o.Name)); n != 1 {
+		t.Fatalf("expected no more restarts after Stop(), got %v", n)
+	}
+	if !process.IsIdle() {
+		t.Fatal("expected the process to stay stopped")
+	}
+}
+
+func TestPersistedGiveUpEndsAfterRestartCooldown(t *testing.T) {
+	config := func() *OndemandUpstreams {
+		return &OndemandUpstreams{
+			Command:         "sleep 0.3; exit 2",
+			Port:            1,
+			RestartPolicy:   "always",
+			MaxRestarts:     1,
+			RestartCooldown: caddy.Duration(time.Second),
+			PersistRestarts: true,
+		}
+	}
+
+	before := newTestUpstream(t, config())
+	if err := get(before); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(before)[0]
+	waitFor(t, 10*time.Second, "the process to be given up on", func() bool { return gaveUp(process) })
+	process.mu.Lock()
+	retry := process.gaveUpAt.Add(process.restartCooldown)
+	process.mu.Unlock()
+
+	// Reload the config.
+	before.Cleanup()
+	after := newTestUpstream(t, config())
+
+	if err := get(after); err == nil || !strings.Contains(err.Error(), "kept exiting") {
+		t.Fatalf("expected the request to fail after the reload, got %v", err)
+	}
+	time.Sleep(time.Until(retry))
+	if err := get(after); err != nil {
+		t.Fatalf("expected the process to be tried again after the cooldown, got %v", err)
+	}
+}
+
+func TestIgnoredInterruptIsForceKilled(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Name:                   "forced-kill",
+		Command:                "trap '' INT; sleep 30",
+		Port:                   1,
+		TerminationGracePeriod: caddy.Duration(300 * time.Millisecond),
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	pid := process.Info().PID
+
+	core, logs := observer.New(zap.WarnLevel)
+	process.mu.Lock()
+	process.logger = zap.New(core)
+	process.mu.Unlock()
+	before := testutil.ToFloat64(forcedKills.WithLabelValues(o.Name))
+
+	process.Stop()
+
+	if process.IsRunning() {
+		t.Fatal("expected the process to be killed")
+	}
+	if kills := testutil.ToFloat64(forcedKills.WithLabelValues(o.Name)) - before; kills != 1 {
+		t.Fatalf("expected 1 forced kill to be counted, got %v", kills)
+	}
+	warnings := logs.FilterMessageSnippet("ignored interrupt").FilterField(zap.Int("pid", pid))
+	if warnings.Len() != 1 {
+		t.Fatalf("expected a warning about the forced kill, got %v", logs.All())
+	}
+}
+
+func TestSingleFailedStartIsRetriedStraightAway(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{Name: "retry-after-failure", Command: "exit 3"})
+
+	for i := 0; i < 2; i++ {
+		if err := get(o); err == nil || strings.Contains(err.Error(), "retrying in") {
+			t.Fatalf("request %d: expected the process to be started, got %v", i, err)
+		}
+	}
+	if err := get(o); err == nil || !strings.Contains(err.Error(), "retrying in") {
+		t.Fatalf("expected requests to back off after two failures in a row, got %v", err)
+	}
+	if starts := testutil.ToFloat64(processStarts.WithLabelValues(o.Name)); starts != 2 {
+		t.Fatalf("expected 2 starts, got %v", starts)
+	}
+}
+
+func TestMaxStartingTimeAbortsStartThatNeverBecomesReady(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		// Nothing listens on the port, so the process never becomes ready.
+		Command:         "echo %d; exec sleep 30",
+		Readiness:       &Readiness{Mode: "tcp", Timeout: caddy.Duration(time.Hour)},
+		MaxStartingTime: caddy.Duration(300 * time.Millisecond),
+	})
+
+	began := time.Now()
+	err := get(o)
+	if err == nil || !strings.Contains(err.Error(), "still starting") {
+		t.Fatalf("expected the start to be aborted, got %v", err)
+	}
+	if took := time.Since(began); took > 5*time.Second {
+		t.Fatalf("expected the start to be aborted after max_starting_time, took %s", took)
+	}
+	if testProcesses(o)[0].IsRunning() {
+		t.Fatal("expected the process to be killed")
+	}
+}
+
+func TestIdleTimeoutWithThrottledActivity(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:          helperCommand("serve", "%d"),
+		Readiness:        &Readiness{Mode: "tcp"},
+		IdleTimeout:      caddy.Duration(time.Second),
+		ActivityInterval: caddy.Duration(300 * time.Millisecond),
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	pid := process.Info().PID
+
+	// Throttled activity still keeps a busy process running.
+	for end := time.Now().Add(2 * time.Second); time.Now().Before(end); time.Sleep(50 * time.Millisecond) {
+		if err := get(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if info := process.Info(); !info.Running || info.PID != pid {
+		t.Fatalf("expected the process to keep running while busy, got %+v (was pid %d)", info, pid)
+	}
+
+	// And once the requests stop, it's stopped for being idle.
+	waitFor(t, 5*time.Second, "the process to be stopped for being idle", func() bool { return !process.IsRunning() })
+}
+
+func BenchmarkLogActivity(b *testing.B) {
+	for _, interval := range []time.Duration{0, 500 * time.Millisecond} {
+		b.Run("interval="+interval.String(), func(b *testing.B) {
+			u := &UpstreamProcess{activityInterval: interval}
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					u.LogActivity()
+				}
+			})
+		})
+	}
+}
+
+func TestIdleStopTurnsAwayNewRequests(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:     helperCommand("serve", "%d"),
+		Readiness:   &Readiness{Mode: "tcp"},
+		IdleTimeout: caddy.Duration(time.Hour),
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	process := testProcesses(o)[0]
+	waitFor(t, time.Second, "the request to finish", func() bool { return process.inFlight.Load() == 0 })
+	process.lastActivity.Store(time.Now().Add(-2 * time.Hour).UnixNano())
+
+	// A request in flight keeps the process running, however long ago the
+	// last activity was.
+	if !process.RequestStarted() {
+		t.Fatal("expected a running process to take the request")
+	}
+	if process.stopIfIdle() {
+		t.Fatal("expected the process not to be stopped with a request in flight")
+	}
+	process.RequestFinished(false)
+
+	// Once the idle timeout decides to stop the process, it doesn't take any
+	// more requests.
+	waitFor(t, 5*time.Second, "the process to be stopped for being idle", func() bool { return !process.IsRunning() })
+	if process.RequestStarted() {
+		t.Fatal("expected a process stopped for being idle not to take requests")
+	}
+
+	// Until it's started again.
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+	if !process.RequestStarted() {
+		t.Fatal("expected the restarted process to take requests")
+	}
+	process.RequestFinished(false)
+}
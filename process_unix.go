@@ -0,0 +1,38 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// defaultShell is the shell used to run commands when none is configured.
+var defaultShell = []string{"sh", "-c"}
+
+// shellCommand returns a command that runs the given command line with shell.
+func shellCommand(shell []string, command string) *exec.Cmd {
+	return exec.Command(shell[0], append(shell[1:], command)...)
+}
+
+// setProcessGroup starts cmd in its own process group, so that interrupt and
+// kill also reach anything it starts, such as the program run by the shell.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// interrupt asks the process group to exit gracefully by sending it SIGINT.
+func interrupt(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+// kill forcibly stops the process group by sending it SIGKILL.
+func kill(cmd *exec.Cmd) error {
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		return cmd.Process.Kill()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+//go:build windows
+
+package caddy_ondemand_upstreams
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// defaultShell is the shell used to run commands when none is configured.
+var defaultShell = []string{"cmd", "/c"}
+
+var generateConsoleCtrlEvent = syscall.NewLazyDLL("kernel32.dll").NewProc("GenerateConsoleCtrlEvent")
+
+// shellCommand returns a command that runs the given command line with shell.
+func shellCommand(shell []string, command string) *exec.Cmd {
+	cmd := exec.Command(shell[0], append(shell[1:], command)...)
+
+	// cmd.exe doesn't parse its command line the way that Go quotes arguments,
+	// so pass the command through untouched, as it would be typed.
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(shell[0])), ".exe")
+	if name == "cmd" {
+		args := make([]string, len(shell))
+		for i, arg := range shell {
+			args[i] = syscall.EscapeArg(arg)
+		}
+		cmd.SysProcAttr = &syscall.SysProcAttr{
+			CmdLine: strings.Join(args, " ") + " " + command,
+		}
+	}
+
+	return cmd
+}
+
+// setProcessGroup starts cmd in a new process group, so that interrupt can
+// send it CTRL_BREAK without also sending it to Caddy.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CreationFlags |= syscall.CREATE_NEW_PROCESS_GROUP
+}
+
+// interrupt asks the process (and anything it started, such as the program run
+// by the shell) to exit gracefully by sending CTRL_BREAK to its process group.
+func interrupt(cmd *exec.Cmd) error {
+	r, _, err := generateConsoleCtrlEvent.Call(syscall.CTRL_BREAK_EVENT, uintptr(cmd.Process.Pid))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+// kill forcibly stops the process and everything it started, such as the
+// program run by cmd /c, with taskkill. If that fails, only the process itself
+// is stopped, with TerminateProcess.
+func kill(cmd *exec.Cmd) error {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run(); err == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,79 @@
+package caddy_ondemand_upstreams
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCommandGetsPortOnWindows(t *testing.T) {
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   helperCommand("serve", "%d", "hello"),
+		Readiness: &Readiness{Mode: "tcp"},
+	})
+	if err := get(o); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + testProcesses(o)[0].GetDial())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("expected the process to serve on the port it was given, got %q", body)
+	}
+}
+
+func TestStopEndsProcessTreeOnWindows(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		helper string
+		forced bool
+	}{
+		{"interrupt", "serve", false},
+		{"kill", "serve-ignoring-interrupt", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := newTestUpstream(t, &OndemandUpstreams{
+				Name:                   "windows-stop-" + tc.name,
+				Command:                helperCommand(tc.helper, "%d"),
+				Readiness:              &Readiness{Mode: "tcp"},
+				TerminationGracePeriod: caddy.Duration(500 * time.Millisecond),
+			})
+			if err := get(o); err != nil {
+				t.Fatal(err)
+			}
+			process := testProcesses(o)[0]
+			dial := process.GetDial()
+
+			process.Stop()
+			if process.IsRunning() {
+				t.Fatal("expected the process to be stopped")
+			}
+
+			// The server is a child of cmd.exe, so it's only gone if the
+			// whole tree was stopped.
+			waitFor(t, 5*time.Second, "the server to stop listening", func() bool {
+				conn, err := net.DialTimeout("tcp", dial, time.Second)
+				if err != nil {
+					return true
+				}
+				conn.Close()
+				return false
+			})
+			if tc.forced && testutil.ToFloat64(forcedKills.WithLabelValues(o.Name)) != 1 {
+				t.Fatal("expected the process to be force-killed")
+			}
+		})
+	}
+}
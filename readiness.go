@@ -0,0 +1,165 @@
+package caddy_ondemand_upstreams
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Readiness describes how to determine that an upstream process is ready to
+// accept requests.
+type Readiness struct {
+	// The type of probe to run. "tcp" waits until a TCP connection to the
+	// upstream succeeds. "http" waits until a GET request to Path returns
+	// Status. "file" waits until the process writes File (and, if FileContent
+	// is set, until File contains FileContent).
+	Mode string `json:"mode,omitempty"`
+
+	// The path to request when Mode is "http". Default: /
+	Path string `json:"path,omitempty"`
+
+	// The status code to expect when Mode is "http". Default: 200
+	Status int `json:"status,omitempty"`
+
+	// The file to watch when Mode is "file". Like the command, %d is
+	// replaced with the port (or %s with the socket path), and relative paths
+	// are resolved against the process's directory. Any existing file is
+	// removed before the process is started.
+	File string `json:"file,omitempty"`
+
+	// Optional. When Mode is "file", the contents (ignoring surrounding
+	// whitespace) that File must have before the process is considered ready.
+	// This lets a process report that it's still starting or degraded by
+	// writing something else to the file.
+	FileContent string `json:"file_content,omitempty"`
+
+	// How long to wait between probe attempts. Default: 100ms
+	Interval caddy.Duration `json:"interval,omitempty"`
+
+	// How long to wait overall for the upstream to become ready before giving
+	// up. Default: 30 seconds
+	Timeout caddy.Duration `json:"timeout,omitempty"`
+}
+
+// Validate checks the readiness configuration and fills in defaults.
+func (r *Readiness) Validate() error {
+	switch r.Mode {
+	case "tcp":
+	case "http":
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		if r.Status == 0 {
+			r.Status = http.StatusOK
+		}
+	case "file":
+		if r.File == "" {
+			return fmt.Errorf("readiness file requires a path")
+		}
+	default:
+		return fmt.Errorf("unknown readiness mode: %s", r.Mode)
+	}
+
+	if r.FileContent != "" && r.Mode != "file" {
+		return fmt.Errorf("ready_file_content requires readiness file")
+	}
+
+	if r.Interval == caddy.Duration(0) {
+		r.Interval = caddy.Duration(100 * time.Millisecond)
+	}
+
+	if r.Timeout == caddy.Duration(0) {
+		r.Timeout = caddy.Duration(30 * time.Second)
+	}
+
+	return nil
+}
+
+// Reset clears any state left behind by a previous process so that it isn't
+// mistaken for readiness of the next one. file is the process's resolved
+// readiness file, if any.
+func (r *Readiness) Reset(file string) {
+	if r.Mode == "file" {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			caddy.Log().Named(CHANNEL).Info("error while removing ready file: " + fmt.Sprint(err))
+		}
+	}
+}
+
+// Wait polls the upstream at the given network address (or its resolved
+// readiness file) until it is ready, the timeout expires, ctx is done, or the
+// exited channel is closed.
+func (r *Readiness) Wait(ctx context.Context, network, addr, file string, exited <-chan struct{}) error {
+	deadline := time.After(time.Duration(r.Timeout))
+	ticker := time.NewTicker(time.Duration(r.Interval))
+	defer ticker.Stop()
+
+	for {
+		if r.probe(network, addr, file) {
+			return nil
+		}
+
+		select {
+		case <-exited:
+			return fmt.Errorf("upstream process exited before becoming ready")
+		case <-deadline:
+			return fmt.Errorf("upstream process was not ready after %s", time.Duration(r.Timeout))
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe makes a single readiness check against addr or file.
+func (r *Readiness) probe(network, addr, file string) bool {
+	switch r.Mode {
+	case "http":
+		client := upstreamClient(network, addr, time.Second)
+		defer client.CloseIdleConnections()
+		resp, err := client.Get("http://localhost" + r.Path)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == r.Status
+
+	case "file":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return false
+		}
+		return r.FileContent == "" || strings.TrimSpace(string(content)) == r.FileContent
+
+	default:
+		conn, err := net.DialTimeout(network, addr, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}
+}
+
+// upstreamClient returns an HTTP client that sends every request to the
+// upstream at the given network address, regardless of the request's URL. This
+// lets probes work the same way for TCP ports and unix sockets.
+func upstreamClient(network, addr string, timeout time.Duration) *http.Client {
+	dialer := net.Dialer{Timeout: timeout}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
@@ -0,0 +1,85 @@
+//go:build unix
+
+package caddy_ondemand_upstreams
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestReadinessFileIsPerProcess(t *testing.T) {
+	dir := t.TempDir()
+	o := newTestUpstream(t, &OndemandUpstreams{
+		Command:   "p=%d; sleep 0.2; echo ok > ready-$p; exec sleep 30",
+		Dir:       dir,
+		Readiness: &Readiness{Mode: "file", File: "ready-%d"},
+	})
+
+	// A file at the unformatted path mustn't count.
+	if err := os.WriteFile(filepath.Join(dir, "ready-%d"), []byte("ok"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	r, cancel := newTestRequest("example.com")
+	defer cancel()
+	if _, err := o.GetUpstreams(r); err != nil {
+		t.Fatal(err)
+	}
+
+	process := testProcesses(o)[0]
+	want := filepath.Join(dir, "ready-"+strconv.Itoa(process.GetPort()))
+	if _, err := os.Stat(want); err != nil {
+		t.Fatalf("expected the process to be ready once it wrote %s: %v", want, err)
+	}
+}
+
+func TestReadinessFileRequiresPlaceholderWithReplicas(t *testing.T) {
+	o := &OndemandUpstreams{
+		Command:   "true",
+		Replicas:  2,
+		Readiness: &Readiness{Mode: "file", File: "ready"},
+	}
+	if err := o.Validate(); err == nil {
+		t.Fatal("expected an error for a shared readiness file")
+	}
+}
+
+func TestReadyFileContent(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ready")
+	r := &Readiness{Mode: "file", File: file, FileContent: "ok"}
+	if err := r.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(file, []byte("starting\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Wait(context.Background(), "tcp", "localhost:0", file, nil)
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("expected not to be ready while the file contains starting, got %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	if err := os.WriteFile(file, []byte("ok\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected to be ready once the file contains ok")
+	}
+}
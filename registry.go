@@ -0,0 +1,140 @@
+package caddy_ondemand_upstreams
+
+import (
+	"sync"
+	"time"
+)
+
+// upstreams is a registry of named OndemandUpstreams, so that one upstream can
+// refer to another (for example, with depends_on). Each name maps to every
+// upstream registered under it, most recent last.
+var (
+	upstreams   = make(map[string][]*OndemandUpstreams)
+	upstreamsMu sync.Mutex
+)
+
+// registerUpstream adds o to the registry under its name. During a config
+// reload, the new config is provisioned before the old one is cleaned up, so
+// an existing entry with the same name is shadowed rather than rejected. If the
+// reload fails, cleaning up the new config brings the old entry back.
+func registerUpstream(o *OndemandUpstreams) {
+	if o.Name == "" {
+		return
+	}
+
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+
+	upstreams[o.Name] = append(upstreams[o.Name], o)
+}
+
+// unregisterUpstream removes o from the registry, leaving any other upstreams
+// registered under the same name.
+func unregisterUpstream(o *OndemandUpstreams) {
+	if o.Name == "" {
+		return
+	}
+
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+
+	registered := upstreams[o.Name]
+	for i, r := range registered {
+		if r == o {
+			registered = append(registered[:i:i], registered[i+1:]...)
+			break
+		}
+	}
+	if len(registered) == 0 {
+		delete(upstreams, o.Name)
+	} else {
+		upstreams[o.Name] = registered
+	}
+}
+
+// lookupUpstream returns the most recently registered upstream with the given
+// name.
+func lookupUpstream(name string) (*OndemandUpstreams, bool) {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+
+	registered := upstreams[name]
+	if len(registered) == 0 {
+		return nil, false
+	}
+	return registered[len(registered)-1], true
+}
+
+// restartStates holds the restart counters of upstream processes that persist
+// them, so that crash-loop protection survives config reloads. It is keyed by
+// command (and replica), since a reload creates entirely new processes.
+var (
+	restartStates   = make(map[string]restartState)
+	restartStatesMu sync.Mutex
+)
+
+// restartState is the part of an UpstreamProcess's state that tracks
+// unexpected exits.
+type restartState struct {
+	restarts int
+	gaveUpAt time.Time
+}
+
+// loadRestartState returns the restart state saved under key, if any.
+func loadRestartState(key string) restartState {
+	restartStatesMu.Lock()
+	defer restartStatesMu.Unlock()
+
+	return restartStates[key]
+}
+
+// saveRestartState saves the restart state under key. A fresh state is removed
+// rather than saved, so that the registry only holds processes that have been
+// crashing.
+func saveRestartState(key string, s restartState) {
+	restartStatesMu.Lock()
+	defer restartStatesMu.Unlock()
+
+	if s == (restartState{}) {
+		delete(restartStates, key)
+		return
+	}
+	restartStates[key] = s
+}
+
+// activeProcesses is a registry of every upstream process that is currently
+// running, across all upstreams, so that they can be listed through the admin
+// API. A process is added once it has been started and removed as soon as it
+// exits, however that happens.
+var (
+	activeProcesses   = make(map[*UpstreamProcess]struct{})
+	activeProcessesMu sync.Mutex
+)
+
+// registerProcess adds u to the registry of running processes.
+func registerProcess(u *UpstreamProcess) {
+	activeProcessesMu.Lock()
+	defer activeProcessesMu.Unlock()
+
+	activeProcesses[u] = struct{}{}
+}
+
+// unregisterProcess removes u from the registry of running processes.
+func unregisterProcess(u *UpstreamProcess) {
+	activeProcessesMu.Lock()
+	defer activeProcessesMu.Unlock()
+
+	delete(activeProcesses, u)
+}
+
+// listProcesses returns every running process.
+func listProcesses() []*UpstreamProcess {
+	activeProcessesMu.Lock()
+	defer activeProcessesMu.Unlock()
+
+	processes := make([]*UpstreamProcess, 0, len(activeProcesses))
+	for u := range activeProcesses {
+		processes = append(processes, u)
+	}
+	return processes
+}
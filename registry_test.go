@@ -0,0 +1,51 @@
+package caddy_ondemand_upstreams
+
+import (
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestFailedReloadKeepsPreviousUpstream(t *testing.T) {
+	old := newTestUpstream(t, &OndemandUpstreams{
+		Name:    "failed-reload",
+		Command: helperCommand("serve", "%d"),
+	})
+
+	// The new config is provisioned, and then cleaned up when the reload
+	// fails.
+	reloaded := &OndemandUpstreams{
+		Name:    "failed-reload",
+		Command: helperCommand("serve", "%d"),
+	}
+	if err := reloaded.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	if o, _ := lookupUpstream("failed-reload"); o != reloaded {
+		t.Fatal("expected the new upstream to be registered while the reload is in progress")
+	}
+	reloaded.Cleanup()
+
+	if o, ok := lookupUpstream("failed-reload"); !ok || o != old {
+		t.Fatal("expected the previous upstream to still be registered")
+	}
+}
+
+func TestReloadReplacesUpstream(t *testing.T) {
+	old := &OndemandUpstreams{
+		Name:    "reload",
+		Command: helperCommand("serve", "%d"),
+	}
+	if err := old.Provision(caddy.Context{}); err != nil {
+		t.Fatal(err)
+	}
+	reloaded := newTestUpstream(t, &OndemandUpstreams{
+		Name:    "reload",
+		Command: helperCommand("serve", "%d"),
+	})
+	old.Cleanup()
+
+	if o, ok := lookupUpstream("reload"); !ok || o != reloaded {
+		t.Fatal("expected the new upstream to be registered")
+	}
+}
@@ -0,0 +1,74 @@
+package caddy_ondemand_upstreams
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// SmokeTest describes a request to send to an upstream process once it is
+// ready, and the response that it must give before any requests are proxied to
+// it. This catches situations like a different backend already listening on
+// the configured port.
+type SmokeTest struct {
+	// The HTTP method to use. Default: GET
+	Method string `json:"method,omitempty"`
+
+	// The path to request. Default: /
+	Path string `json:"path,omitempty"`
+
+	// A regular expression that the response body must match.
+	Expect string `json:"expect,omitempty"`
+
+	expect *regexp.Regexp
+}
+
+// Validate checks the smoke test configuration and fills in defaults.
+func (s *SmokeTest) Validate() error {
+	if s.Method == "" {
+		s.Method = http.MethodGet
+	}
+	if s.Path == "" {
+		s.Path = "/"
+	}
+
+	expect, err := regexp.Compile(s.Expect)
+	if err != nil {
+		return fmt.Errorf("invalid smoke_test expectation: %v", err)
+	}
+	s.expect = expect
+
+	return nil
+}
+
+// Run sends the smoke test request to the upstream at the given network
+// address and returns an error if the response doesn't match.
+func (s *SmokeTest) Run(ctx context.Context, network, addr string) error {
+	client := upstreamClient(network, addr, 10*time.Second)
+	defer client.CloseIdleConnections()
+
+	req, err := http.NewRequestWithContext(ctx, s.Method, "http://localhost"+s.Path, nil)
+	if err != nil {
+		return fmt.Errorf("smoke test failed: %v", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("smoke test failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// Don't let a misbehaving upstream make us read forever.
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("smoke test failed: %v", err)
+	}
+
+	if !s.expect.Match(body) {
+		return fmt.Errorf("smoke test failed: %s %s returned %d with a body that does not match %q", s.Method, s.Path, resp.StatusCode, s.Expect)
+	}
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package caddy_ondemand_upstreams
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSmokeTest(t *testing.T) {
+	newUpstream := func(expect string) *OndemandUpstreams {
+		return newTestUpstream(t, &OndemandUpstreams{
+			Command:   helperCommand("serve", "%d", "hello"),
+			Readiness: &Readiness{Mode: "tcp"},
+			SmokeTest: &SmokeTest{Expect: expect},
+		})
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		o := newUpstream("^ok$")
+		err := get(o)
+		if err == nil || !strings.Contains(err.Error(), `does not match "^ok$"`) {
+			t.Fatalf("expected the start to fail the smoke test, got %v", err)
+		}
+		if testProcesses(o)[0].IsRunning() {
+			t.Fatal("expected the process to be killed")
+		}
+	})
+
+	t.Run("match", func(t *testing.T) {
+		if err := get(newUpstream("^hello$")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}